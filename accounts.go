@@ -0,0 +1,129 @@
+package main
+
+import (
+  "fmt"
+  "regexp"
+  "sync"
+
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/cloudwatch"
+  "github.com/aws/aws-sdk-go/service/route53"
+)
+
+// Identity for reading hosted zones and health checks that live in another AWS account
+// A role is assumed from the profile when both are set, otherwise from the fetch session
+type AccountSpec struct {
+  RoleArn    string `json:",omitempty"`
+  ExternalId string `json:",omitempty"`
+  Profile    string `json:",omitempty"`
+}
+
+// Zone ids are cached per account since the same id can't be read with another account's credentials
+type ZoneKey struct {
+  Account      string
+  HostedZoneId string
+}
+
+// Clients and health sources for one account
+type AWSClients struct {
+  Route53       Route53API
+  CloudWatch    CloudWatchAPI
+  HealthSources map[string]HealthSource
+}
+
+var roleArnPattern = regexp.MustCompile(`^arn:aws[a-z-]*:iam::\d{12}:role/.+$`)
+
+var sessFetch *session.Session
+var fetchConfig *aws.Config
+var defaultClients *AWSClients
+
+var accountClientsMu sync.Mutex
+var accountClients = make(map[string]*AWSClients)
+
+func (account *AccountSpec) validate() error {
+  if account.RoleArn == "" && account.Profile == "" {
+    return fmt.Errorf("RoleArn or Profile is required")
+  }
+  if account.RoleArn != "" && !roleArnPattern.MatchString(account.RoleArn) {
+    return fmt.Errorf("invalid role ARN %q", account.RoleArn)
+  }
+  if account.ExternalId != "" && account.RoleArn == "" {
+    return fmt.Errorf("ExternalId requires RoleArn")
+  }
+  return nil
+}
+
+// Empty for the default fetch account
+func (account *AccountSpec) key() string {
+  if account == nil {
+    return ""
+  }
+  return account.Profile + "|" + account.RoleArn + "|" + account.ExternalId
+}
+
+// An environment's own account takes precedence over its service's
+func environmentAccount(serviceSpec *ServiceSpec, environmentSpec *EnvironmentSpec) *AccountSpec {
+  if environmentSpec.Account != nil {
+    return environmentSpec.Account
+  }
+  return serviceSpec.Account
+}
+
+func zoneKey(account *AccountSpec, hostedZoneId string) ZoneKey {
+  return ZoneKey{Account: account.key(), HostedZoneId: hostedZoneId}
+}
+
+func newAWSClients(sess *session.Session) *AWSClients {
+  return clientsWith(route53.New(sess, endpointConfig(CONFIG.Route53Endpoint)), cloudwatch.New(sess, endpointConfig(CONFIG.CloudWatchEndpoint)))
+}
+
+func clientsWith(r53 Route53API, cw CloudWatchAPI) *AWSClients {
+  return &AWSClients{
+    Route53:    r53,
+    CloudWatch: cw,
+    HealthSources: map[string]HealthSource{
+      "cloudwatch":       &CloudWatchHealthSource{client: cw},
+      "cloudwatch-batch": &BatchCloudWatchHealthSource{client: cw},
+      "route53":          &Route53HealthSource{client: r53},
+    },
+  }
+}
+
+// Returns the clients for an account, creating and caching them on first use
+func clientsFor(account *AccountSpec) (*AWSClients, error) {
+  key := account.key()
+  if key == "" {
+    return defaultClients, nil
+  }
+
+  accountClientsMu.Lock()
+  defer accountClientsMu.Unlock()
+  if clients, ok := accountClients[key]; ok {
+    return clients, nil
+  }
+
+  var sess *session.Session
+  if account.Profile != "" {
+    var err error
+    sess, err = newAWSSession(CredentialSpec{Profile: account.Profile, RoleArn: account.RoleArn, ExternalId: account.ExternalId}, fetchConfig)
+    if err != nil {
+      return nil, err
+    }
+    instrumentSession(sess)
+  } else {
+    // Copies keep the fetch session's instrumented handlers
+    roleCreds := stscreds.NewCredentials(sessFetch, account.RoleArn, func(provider *stscreds.AssumeRoleProvider) {
+      provider.RoleSessionName = roleSessionName
+      if account.ExternalId != "" {
+        provider.ExternalID = aws.String(account.ExternalId)
+      }
+    })
+    sess = sessFetch.Copy(&aws.Config{Credentials: roleCreds})
+  }
+
+  clients := newAWSClients(sess)
+  accountClients[key] = clients
+  return clients, nil
+}
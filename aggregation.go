@@ -0,0 +1,116 @@
+package main
+
+import (
+  "fmt"
+)
+
+// How instance health rolls up into environment health
+// Policy is one of best (default), worst, quorum or percent
+// DegradedPercent is a pointer so an explicit 0, never failing, can be told apart from the default
+type AggregationSpec struct {
+  Policy          string
+  Quorum          int      `json:",omitempty"`
+  OkPercent       float64  `json:",omitempty"`
+  DegradedPercent *float64 `json:",omitempty"`
+}
+
+const (
+  defaultOkPercent       = 100
+  defaultDegradedPercent = 50
+)
+
+func (spec *AggregationSpec) validate() error {
+  switch spec.Policy {
+  case "", "best", "worst":
+  case "quorum":
+    if spec.Quorum < 0 {
+      return fmt.Errorf("quorum must not be negative")
+    }
+  case "percent":
+    okPercent, degradedPercent := spec.percents()
+    if okPercent <= 0 || okPercent > 100 || degradedPercent < 0 || degradedPercent > okPercent {
+      return fmt.Errorf("percent thresholds must satisfy 0 <= DegradedPercent <= OkPercent <= 100")
+    }
+  default:
+    return fmt.Errorf("unknown aggregation policy %q", spec.Policy)
+  }
+  return nil
+}
+
+func (spec *AggregationSpec) percents() (float64, float64) {
+  okPercent := spec.OkPercent
+  if okPercent == 0 {
+    okPercent = defaultOkPercent
+  }
+  var degradedPercent float64
+  if spec.DegradedPercent != nil {
+    degradedPercent = *spec.DegradedPercent
+  } else {
+    degradedPercent = defaultDegradedPercent
+    if degradedPercent > okPercent {
+      degradedPercent = okPercent
+    }
+  }
+  return okPercent, degradedPercent
+}
+
+// Sets the environment's health from its instances
+// Environments without instances keep their "No Health Status Found" state
+func aggregateEnvironment(spec *AggregationSpec, environment *Environment) {
+  if len(environment.Instances) == 0 {
+    return
+  }
+
+  healthy := 0
+  for _, instance := range environment.Instances {
+    if instance.Health == 0 {
+      healthy++
+    }
+  }
+  total := len(environment.Instances)
+
+  switch spec.Policy {
+  case "worst":
+    environment.Health, environment.Reason = -1, ""
+    for _, instance := range environment.Instances {
+      if instance.Health > environment.Health {
+        environment.Health = instance.Health
+        environment.Reason = instance.Reason
+      }
+    }
+  case "quorum":
+    // Without an explicit quorum a simple majority must be healthy
+    // An explicit quorum holds even when records have gone from DNS, so losing them counts against it
+    quorum := spec.Quorum
+    if quorum == 0 {
+      quorum = total/2 + 1
+    }
+    switch {
+    case healthy >= quorum:
+      environment.Health, environment.Reason = 0, ""
+    case healthy > 0:
+      environment.Health, environment.Reason = 1, fmt.Sprintf("Below Quorum (%d of %d instances healthy, %d required)", healthy, total, quorum)
+    default:
+      environment.Health, environment.Reason = 2, fmt.Sprintf("No Healthy Instances (%d instances)", total)
+    }
+  case "percent":
+    okPercent, degradedPercent := spec.percents()
+    percent := float64(healthy) * 100 / float64(total)
+    switch {
+    case percent >= okPercent:
+      environment.Health, environment.Reason = 0, ""
+    case percent >= degradedPercent:
+      environment.Health, environment.Reason = 1, fmt.Sprintf("Degraded (%d of %d instances healthy)", healthy, total)
+    default:
+      environment.Health, environment.Reason = 2, fmt.Sprintf("Failing (%d of %d instances healthy)", healthy, total)
+    }
+  default:
+    // Best instance wins, so an environment is up while any instance is up
+    for _, instance := range environment.Instances {
+      if instance.Health < environment.Health {
+        environment.Health = instance.Health
+        environment.Reason = instance.Reason
+      }
+    }
+  }
+}
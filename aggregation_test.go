@@ -0,0 +1,47 @@
+package main
+
+import (
+  "testing"
+
+  "github.com/aws/aws-sdk-go/aws"
+)
+
+func TestAggregateEnvironment(t *testing.T) {
+  instances := func(healths ...int) []Instance {
+    var result []Instance
+    for _, health := range healths {
+      result = append(result, Instance{Health: health, Reason: map[int]string{1: "No Alarm Found", 2: "Healthcheck Failing"}[health]})
+    }
+    return result
+  }
+
+  tests := []struct {
+    name      string
+    spec      AggregationSpec
+    instances []Instance
+    want      HealthCheck
+  }{
+    {"no instances", AggregationSpec{}, nil, HealthCheck{3, "No Health Status Found"}},
+    {"best", AggregationSpec{}, instances(2, 0, 1), HealthCheck{0, ""}},
+    {"best all failing", AggregationSpec{Policy: "best"}, instances(2, 2), HealthCheck{2, "Healthcheck Failing"}},
+    {"worst", AggregationSpec{Policy: "worst"}, instances(0, 1, 0), HealthCheck{1, "No Alarm Found"}},
+    {"quorum majority", AggregationSpec{Policy: "quorum"}, instances(0, 0, 2), HealthCheck{0, ""}},
+    {"quorum below", AggregationSpec{Policy: "quorum", Quorum: 3}, instances(0, 0, 2), HealthCheck{1, "Below Quorum (2 of 3 instances healthy, 3 required)"}},
+    {"quorum none healthy", AggregationSpec{Policy: "quorum"}, instances(2, 1), HealthCheck{2, "No Healthy Instances (2 instances)"}},
+    {"quorum with records missing", AggregationSpec{Policy: "quorum", Quorum: 3}, instances(0, 0), HealthCheck{1, "Below Quorum (2 of 2 instances healthy, 3 required)"}},
+    {"percent ok", AggregationSpec{Policy: "percent", OkPercent: 75}, instances(0, 0, 0, 2), HealthCheck{0, ""}},
+    {"percent degraded", AggregationSpec{Policy: "percent"}, instances(0, 2), HealthCheck{1, "Degraded (1 of 2 instances healthy)"}},
+    {"percent failing", AggregationSpec{Policy: "percent"}, instances(0, 2, 2), HealthCheck{2, "Failing (1 of 3 instances healthy)"}},
+    {"percent never failing", AggregationSpec{Policy: "percent", DegradedPercent: aws.Float64(0)}, instances(2, 2, 2), HealthCheck{1, "Degraded (0 of 3 instances healthy)"}},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      environment := Environment{Health: 3, Reason: "No Health Status Found", Instances: test.instances}
+      aggregateEnvironment(&test.spec, &environment)
+      if got := (HealthCheck{environment.Health, environment.Reason}); got != test.want {
+        t.Errorf("health = %+v, want %+v", got, test.want)
+      }
+    })
+  }
+}
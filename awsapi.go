@@ -0,0 +1,32 @@
+package main
+
+import (
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/request"
+  "github.com/aws/aws-sdk-go/service/cloudwatch"
+  "github.com/aws/aws-sdk-go/service/route53"
+  "github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The subsets of the SDK clients the poller and sinks use, so tests can substitute fakes
+// The vendored SDK has no *iface packages; the SDK clients satisfy these as they are
+
+type Route53API interface {
+  ListHostedZonesPagesWithContext(ctx aws.Context, input *route53.ListHostedZonesInput, fn func(*route53.ListHostedZonesOutput, bool) bool, opts ...request.Option) error
+  ListResourceRecordSetsWithContext(ctx aws.Context, input *route53.ListResourceRecordSetsInput, opts ...request.Option) (*route53.ListResourceRecordSetsOutput, error)
+  ListTagsForResourcesWithContext(ctx aws.Context, input *route53.ListTagsForResourcesInput, opts ...request.Option) (*route53.ListTagsForResourcesOutput, error)
+  GetHealthCheckStatusWithContext(ctx aws.Context, input *route53.GetHealthCheckStatusInput, opts ...request.Option) (*route53.GetHealthCheckStatusOutput, error)
+}
+
+type CloudWatchAPI interface {
+  DescribeAlarmsPagesWithContext(ctx aws.Context, input *cloudwatch.DescribeAlarmsInput, fn func(*cloudwatch.DescribeAlarmsOutput, bool) bool, opts ...request.Option) error
+  DescribeAlarmsForMetricWithContext(ctx aws.Context, input *cloudwatch.DescribeAlarmsForMetricInput, opts ...request.Option) (*cloudwatch.DescribeAlarmsForMetricOutput, error)
+}
+
+type S3API interface {
+  PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error)
+}
+
+var _ Route53API = (*route53.Route53)(nil)
+var _ CloudWatchAPI = (*cloudwatch.CloudWatch)(nil)
+var _ S3API = (*s3.S3)(nil)
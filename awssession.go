@@ -0,0 +1,129 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "time"
+
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/credentials"
+  "github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Identity used for one AWS session
+// Static keys win when set; otherwise the profile or the default chain (environment, shared
+// config, web identity, ECS/EC2 metadata) supplies the base credentials, optionally used to assume RoleArn
+type CredentialSpec struct {
+  AccessKeyId     string
+  SecretAccessKey string
+  Profile         string
+  RoleArn         string
+  ExternalId      string
+}
+
+const roleSessionName = "route53-healthcheck-status"
+
+// Overrides the endpoint of one AWS service client, e.g. for LocalStack-style stand-ins
+func endpointConfig(endpoint string) *aws.Config {
+  config := &aws.Config{}
+  if endpoint != "" {
+    config.Endpoint = aws.String(endpoint)
+  }
+  return config
+}
+
+// S3 clients use the sink's bucket region, falling back to S3_REGION and then the session region
+func s3Config(region string) *aws.Config {
+  config := endpointConfig(CONFIG.S3Endpoint)
+  if region == "" {
+    region = CONFIG.S3Region
+  }
+  if region != "" {
+    config.Region = aws.String(region)
+  }
+  if CONFIG.S3ForcePathStyle {
+    config.S3ForcePathStyle = aws.Bool(true)
+  }
+  return config
+}
+
+func newAWSSession(spec CredentialSpec, config *aws.Config) (*session.Session, error) {
+  opts := session.Options{
+    Config:            *config,
+    Profile:           spec.Profile,
+    SharedConfigState: session.SharedConfigEnable,
+  }
+
+  if spec.AccessKeyId != "" {
+    opts.Config.Credentials = credentials.NewStaticCredentials(spec.AccessKeyId, spec.SecretAccessKey, "")
+  } else if spec.Profile == "" {
+    // This SDK version predates web identity support in the default chain, so add it for IRSA
+    tokenFile, roleArn := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN")
+    if tokenFile != "" && roleArn != "" {
+      stsSession, err := session.NewSession(config.Copy(&aws.Config{Credentials: credentials.AnonymousCredentials}))
+      if err != nil {
+        return nil, err
+      }
+      opts.Config.Credentials = credentials.NewCredentials(&WebIdentityProvider{
+        client:    sts.New(stsSession),
+        roleArn:   roleArn,
+        tokenFile: tokenFile,
+      })
+    }
+  }
+
+  sess, err := session.NewSessionWithOptions(opts)
+  if err != nil {
+    return nil, err
+  }
+
+  if spec.RoleArn != "" {
+    roleCreds := stscreds.NewCredentials(sess, spec.RoleArn, func(provider *stscreds.AssumeRoleProvider) {
+      provider.RoleSessionName = roleSessionName
+      if spec.ExternalId != "" {
+        provider.ExternalID = aws.String(spec.ExternalId)
+      }
+    })
+    sess = sess.Copy(&aws.Config{Credentials: roleCreds})
+  }
+  return sess, nil
+}
+
+// Exchanges the projected service account token for role credentials
+type WebIdentityProvider struct {
+  credentials.Expiry
+  client    *sts.STS
+  roleArn   string
+  tokenFile string
+}
+
+func (provider *WebIdentityProvider) Retrieve() (credentials.Value, error) {
+  token, err := ioutil.ReadFile(provider.tokenFile)
+  if err != nil {
+    return credentials.Value{}, err
+  }
+
+  sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+  if sessionName == "" {
+    sessionName = roleSessionName
+  }
+  result, err := provider.client.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
+    RoleArn:          aws.String(provider.roleArn),
+    RoleSessionName:  aws.String(sessionName),
+    WebIdentityToken: aws.String(string(token)),
+  })
+  if err != nil {
+    return credentials.Value{}, err
+  }
+
+  // Refresh a little early so in-flight requests don't use expiring credentials
+  provider.SetExpiration(aws.TimeValue(result.Credentials.Expiration), time.Minute)
+  return credentials.Value{
+    AccessKeyID:     aws.StringValue(result.Credentials.AccessKeyId),
+    SecretAccessKey: aws.StringValue(result.Credentials.SecretAccessKey),
+    SessionToken:    aws.StringValue(result.Credentials.SessionToken),
+    ProviderName:    "WebIdentityProvider",
+  }, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+  "fmt"
+  "io/ioutil"
+  "os"
+  "os/signal"
+  "syscall"
+  "time"
+
+  log "github.com/Sirupsen/logrus"
+  "github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Service config and the sinks built from it, swapped together on reload
+type LoadedConfig struct {
+  Service *ServiceConfig
+  Sinks   []Sink
+}
+
+const configPollInterval = 5 * time.Second
+
+var sessPost *session.Session
+
+// Signalled after a reload so checkRoute53 fetches any new hosted zones straight away
+var configReloaded = make(chan struct{}, 1)
+
+func currentConfig() *LoadedConfig {
+  return state.Config()
+}
+
+// Reads and validates the config file and builds its sinks without touching the running config
+func loadConfig(path string) (*LoadedConfig, error) {
+  config, err := ioutil.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  serviceConfig, problems := parseServiceConfig(path, config)
+  if len(problems) > 0 {
+    return nil, problems
+  }
+  sinks, err := newSinks(serviceConfig, sessPost)
+  if err != nil {
+    return nil, fmt.Errorf("output sinks: %v", err)
+  }
+  return &LoadedConfig{Service: serviceConfig, Sinks: sinks}, nil
+}
+
+// Swaps in the config file's current contents, keeping the running config if they are invalid
+func reloadConfig(path string) {
+  config, err := loadConfig(path)
+  if err != nil {
+    log.Error("Not reloading config file ", path, "; ", err)
+    return
+  }
+
+  state.storeConfig(config)
+  log.SetOutput(logOutput(config.Sinks))
+  log.Info("Reloaded config file ", path, " with ", len(config.Service.ServiceSpecs), " services")
+
+  select {
+  case configReloaded <- struct{}{}:
+  default:
+  }
+}
+
+// Reloads on SIGHUP and whenever the file changes
+// Polls with stat rather than watching the inode, since ConfigMap updates swap a symlink
+func watchConfig(path string) {
+  hup := make(chan os.Signal, 1)
+  signal.Notify(hup, syscall.SIGHUP)
+
+  lastStat, _ := os.Stat(path)
+  ticker := time.NewTicker(configPollInterval)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-hup:
+      log.Info("Received SIGHUP, reloading config file ", path)
+      lastStat, _ = os.Stat(path)
+      reloadConfig(path)
+    case <-ticker.C:
+      stat, err := os.Stat(path)
+      if err != nil {
+        continue
+      }
+      if lastStat == nil || !stat.ModTime().Equal(lastStat.ModTime()) || stat.Size() != lastStat.Size() {
+        log.Info("Config file ", path, " changed, reloading")
+        lastStat = stat
+        reloadConfig(path)
+      }
+    }
+  }
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+  "context"
+  "fmt"
+  "regexp"
+  "sort"
+  "strings"
+
+  log "github.com/Sirupsen/logrus"
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/service/route53"
+)
+
+// Finds health-checked record sets in hosted zones and turns them into services and environments
+// Rule "tags" (default) groups by tags on the health check; rule "naming" matches record names against
+// NamePattern, whose "service" and "environment" named groups give the grouping
+type DiscoverySpec struct {
+  HostedZoneIds  []string     `json:",omitempty"`
+  Rule           string
+  NamePattern    string       `json:",omitempty"`
+  ServiceTag     string       `json:",omitempty"`
+  EnvironmentTag string       `json:",omitempty"`
+  Account        *AccountSpec `json:",omitempty"`
+}
+
+const (
+  defaultServiceTag     = "Service"
+  defaultEnvironmentTag = "Environment"
+  // ListTagsForResources accepts at most 10 resource ids per call
+  maxTagResources = 10
+)
+
+func (spec *DiscoverySpec) validate() error {
+  switch spec.Rule {
+  case "", "tags":
+  case "naming":
+    if _, err := spec.namePattern(); err != nil {
+      return err
+    }
+  default:
+    return fmt.Errorf("unknown discovery rule %q", spec.Rule)
+  }
+  for _, hostedZoneId := range spec.HostedZoneIds {
+    if !hostedZoneIdPattern.MatchString(hostedZoneId) {
+      return fmt.Errorf("invalid hosted zone id %q", hostedZoneId)
+    }
+  }
+  if spec.Account != nil {
+    if err := spec.Account.validate(); err != nil {
+      return fmt.Errorf("Account: %v", err)
+    }
+  }
+  return nil
+}
+
+func (spec *DiscoverySpec) namePattern() (*regexp.Regexp, error) {
+  pattern, err := regexp.Compile(spec.NamePattern)
+  if err != nil {
+    return nil, fmt.Errorf("invalid NamePattern: %v", err)
+  }
+  var service, environment bool
+  for _, name := range pattern.SubexpNames() {
+    service = service || name == "service"
+    environment = environment || name == "environment"
+  }
+  if !service || !environment {
+    return nil, fmt.Errorf("NamePattern must have named groups \"service\" and \"environment\"")
+  }
+  return pattern, nil
+}
+
+// Static services and environments take precedence; discovered environments are added to a static service
+// of the same name and discovered services are appended in name order
+func mergeServiceSpecs(static []ServiceSpec, discovered []ServiceSpec) []ServiceSpec {
+  if len(discovered) == 0 {
+    return static
+  }
+
+  merged := make([]ServiceSpec, len(static))
+  index := make(map[string]int)
+  for i, serviceSpec := range static {
+    serviceSpec.EnvironmentSpecs = append([]EnvironmentSpec(nil), serviceSpec.EnvironmentSpecs...)
+    merged[i] = serviceSpec
+    index[serviceSpec.Name] = i
+  }
+
+  for _, serviceSpec := range discovered {
+    i, ok := index[serviceSpec.Name]
+    if !ok {
+      index[serviceSpec.Name] = len(merged)
+      merged = append(merged, serviceSpec)
+      continue
+    }
+    for _, environmentSpec := range serviceSpec.EnvironmentSpecs {
+      if !hasEnvironmentSpec(&merged[i], environmentSpec.Name) {
+        merged[i].EnvironmentSpecs = append(merged[i].EnvironmentSpecs, environmentSpec)
+      }
+    }
+  }
+  return merged
+}
+
+func hasEnvironmentSpec(serviceSpec *ServiceSpec, name string) bool {
+  for _, environmentSpec := range serviceSpec.EnvironmentSpecs {
+    if environmentSpec.Name == name {
+      return true
+    }
+  }
+  return false
+}
+
+// Scans the configured hosted zones, or all of them, adding every zone read to hostedZones
+// clients must belong to the discovery account
+func discoverServices(ctx context.Context, spec *DiscoverySpec, clients *AWSClients, hostedZones map[ZoneKey][]*route53.ResourceRecordSet) ([]ServiceSpec, error) {
+  var err error
+  hostedZoneIds := spec.HostedZoneIds
+  if len(hostedZoneIds) == 0 {
+    err = clients.Route53.ListHostedZonesPagesWithContext(ctx, &route53.ListHostedZonesInput{}, func(page *route53.ListHostedZonesOutput, lastPage bool) bool {
+      for _, hostedZone := range page.HostedZones {
+        hostedZoneIds = append(hostedZoneIds, trimHostedZoneId(aws.StringValue(hostedZone.Id)))
+      }
+      return true
+    })
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  var pattern *regexp.Regexp
+  if spec.Rule == "naming" {
+    if pattern, err = spec.namePattern(); err != nil {
+      return nil, err
+    }
+  }
+
+  type candidate struct {
+    hostedZoneId string
+    recordSet    *route53.ResourceRecordSet
+  }
+  var candidates []candidate
+  for _, hostedZoneId := range hostedZoneIds {
+    key := zoneKey(spec.Account, hostedZoneId)
+    records, ok := hostedZones[key]
+    if !ok {
+      if records, err = fetchHostedZone(ctx, clients.Route53, hostedZoneId); err != nil {
+        return nil, err
+      }
+      hostedZones[key] = records
+    }
+    for _, recordSet := range records {
+      if aws.StringValue(recordSet.HealthCheckId) != "" {
+        candidates = append(candidates, candidate{hostedZoneId: hostedZoneId, recordSet: recordSet})
+      }
+    }
+  }
+
+  var tags map[string]map[string]string
+  if spec.Rule != "naming" {
+    var healthCheckIds []string
+    for _, c := range candidates {
+      healthCheckIds = append(healthCheckIds, aws.StringValue(c.recordSet.HealthCheckId))
+    }
+    if tags, err = fetchHealthCheckTags(ctx, clients.Route53, healthCheckIds); err != nil {
+      return nil, err
+    }
+  }
+
+  serviceTag, environmentTag := spec.ServiceTag, spec.EnvironmentTag
+  if serviceTag == "" {
+    serviceTag = defaultServiceTag
+  }
+  if environmentTag == "" {
+    environmentTag = defaultEnvironmentTag
+  }
+
+  services := make(map[string]*ServiceSpec)
+  for _, c := range candidates {
+    domainName := strings.TrimSuffix(aws.StringValue(c.recordSet.Name), ".")
+    var serviceName, environmentName string
+    if pattern != nil {
+      match := pattern.FindStringSubmatch(domainName)
+      if match == nil {
+        continue
+      }
+      for i, name := range pattern.SubexpNames() {
+        switch name {
+        case "service":
+          serviceName = match[i]
+        case "environment":
+          environmentName = match[i]
+        }
+      }
+    } else {
+      healthCheckTags := tags[aws.StringValue(c.recordSet.HealthCheckId)]
+      serviceName, environmentName = healthCheckTags[serviceTag], healthCheckTags[environmentTag]
+    }
+    if serviceName == "" || environmentName == "" {
+      continue
+    }
+
+    serviceSpec, ok := services[serviceName]
+    if !ok {
+      serviceSpec = &ServiceSpec{Name: serviceName, DisplayName: serviceName}
+      services[serviceName] = serviceSpec
+    }
+    addDiscoveredRecord(serviceSpec, environmentName, spec.Account, c.hostedZoneId, domainName, aws.StringValue(c.recordSet.Type))
+  }
+
+  names := make([]string, 0, len(services))
+  for name := range services {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  discovered := make([]ServiceSpec, 0, len(names))
+  for _, name := range names {
+    discovered = append(discovered, *services[name])
+  }
+  return discovered, nil
+}
+
+// An environment covers one domain name; other domains tagged with the same environment are ignored
+// Environments carry the discovery account so they keep it when merged into a static service
+func addDiscoveredRecord(serviceSpec *ServiceSpec, environmentName string, account *AccountSpec, hostedZoneId string, domainName string, recordType string) {
+  for i := range serviceSpec.EnvironmentSpecs {
+    environmentSpec := &serviceSpec.EnvironmentSpecs[i]
+    if environmentSpec.Name != environmentName {
+      continue
+    }
+    if environmentSpec.HostedZoneId != hostedZoneId || environmentSpec.DomainName != domainName {
+      log.Warn("Discovered ", serviceSpec.Name, "/", environmentName, " at both ", environmentSpec.DomainName, " and ", domainName, "; keeping ", environmentSpec.DomainName)
+      return
+    }
+    if !containsString(environmentSpec.RecordTypes, recordType) {
+      environmentSpec.RecordTypes = append(environmentSpec.RecordTypes, recordType)
+    }
+    return
+  }
+  serviceSpec.EnvironmentSpecs = append(serviceSpec.EnvironmentSpecs, EnvironmentSpec{
+    Name:         environmentName,
+    HostedZoneId: hostedZoneId,
+    DomainName:   domainName,
+    RecordTypes:  []string{recordType},
+    Account:      account,
+  })
+}
+
+// Returns the tags of each health check, keyed by health check id
+func fetchHealthCheckTags(ctx context.Context, r53 Route53API, healthCheckIds []string) (map[string]map[string]string, error) {
+  tags := make(map[string]map[string]string)
+  seen := make(map[string]bool)
+  var unique []string
+  for _, id := range healthCheckIds {
+    if !seen[id] {
+      seen[id] = true
+      unique = append(unique, id)
+    }
+  }
+
+  for start := 0; start < len(unique); start += maxTagResources {
+    end := start + maxTagResources
+    if end > len(unique) {
+      end = len(unique)
+    }
+    result, err := r53.ListTagsForResourcesWithContext(ctx, &route53.ListTagsForResourcesInput{
+      ResourceIds:  aws.StringSlice(unique[start:end]),
+      ResourceType: aws.String(route53.TagResourceTypeHealthcheck),
+    })
+    if err != nil {
+      return nil, err
+    }
+    for _, tagSet := range result.ResourceTagSets {
+      resourceTags := make(map[string]string)
+      for _, tag := range tagSet.Tags {
+        resourceTags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+      }
+      tags[aws.StringValue(tagSet.ResourceId)] = resourceTags
+    }
+  }
+  return tags, nil
+}
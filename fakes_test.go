@@ -0,0 +1,219 @@
+package main
+
+import (
+  "io/ioutil"
+  "sort"
+  "sync"
+  "time"
+
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/awserr"
+  "github.com/aws/aws-sdk-go/aws/client"
+  "github.com/aws/aws-sdk-go/aws/request"
+  "github.com/aws/aws-sdk-go/service/cloudwatch"
+  "github.com/aws/aws-sdk-go/service/route53"
+  "github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Serves canned hosted zones, two records per page, and health checker observations
+// Zones in zoneErrors always fail; zones in throttledCalls are throttled that many times first,
+// and with throttleEvery set every throttleEvery-th page request is throttled, part way through listings
+type fakeRoute53 struct {
+  mu             sync.Mutex
+  zones          map[string][]*route53.ResourceRecordSet
+  zoneErrors     map[string]error
+  throttledCalls map[string]int
+  observations   map[string][]*route53.HealthCheckObservation
+  throttleEvery  int
+  recordCalls    int
+  // How the SDK would have retried the last page request, given the caller's request options
+  retryer request.Retryer
+}
+
+func (fake *fakeRoute53) ListHostedZonesPagesWithContext(ctx aws.Context, input *route53.ListHostedZonesInput, fn func(*route53.ListHostedZonesOutput, bool) bool, opts ...request.Option) error {
+  page := &route53.ListHostedZonesOutput{}
+  for id := range fake.zones {
+    page.HostedZones = append(page.HostedZones, &route53.HostedZone{Id: aws.String("/hostedzone/" + id)})
+  }
+  fn(page, true)
+  return nil
+}
+
+func (fake *fakeRoute53) ListResourceRecordSetsWithContext(ctx aws.Context, input *route53.ListResourceRecordSetsInput, opts ...request.Option) (*route53.ListResourceRecordSetsOutput, error) {
+  if err := ctx.Err(); err != nil {
+    return nil, err
+  }
+  id := aws.StringValue(input.HostedZoneId)
+  req := &request.Request{Retryer: client.DefaultRetryer{NumMaxRetries: 3}}
+  req.ApplyOptions(opts...)
+  fake.mu.Lock()
+  fake.recordCalls++
+  fake.retryer = req.Retryer
+  throttled := fake.throttledCalls[id] > 0
+  if throttled {
+    fake.throttledCalls[id]--
+  }
+  throttled = throttled || (fake.throttleEvery > 0 && fake.recordCalls%fake.throttleEvery == 0)
+  fake.mu.Unlock()
+  if throttled {
+    return nil, awserr.New("Throttling", "Rate exceeded", nil)
+  }
+  if err := fake.zoneErrors[id]; err != nil {
+    return nil, err
+  }
+
+  // Pages start at the record matching the StartRecord fields, as Route53's do
+  records := fake.zones[id]
+  start := 0
+  if input.StartRecordName != nil {
+    start = -1
+    for i, record := range records {
+      if aws.StringValue(record.Name) == aws.StringValue(input.StartRecordName) && aws.StringValue(record.Type) == aws.StringValue(input.StartRecordType) &&
+        aws.StringValue(record.SetIdentifier) == aws.StringValue(input.StartRecordIdentifier) {
+        start = i
+        break
+      }
+    }
+    if start < 0 {
+      return nil, awserr.New("InvalidInput", "No record to start from", nil)
+    }
+  }
+  end := start + 2
+  if end > len(records) {
+    end = len(records)
+  }
+  page := &route53.ListResourceRecordSetsOutput{ResourceRecordSets: records[start:end], IsTruncated: aws.Bool(end < len(records))}
+  if end < len(records) {
+    page.NextRecordName, page.NextRecordType, page.NextRecordIdentifier = records[end].Name, records[end].Type, records[end].SetIdentifier
+  }
+  return page, nil
+}
+
+func (fake *fakeRoute53) ListTagsForResourcesWithContext(ctx aws.Context, input *route53.ListTagsForResourcesInput, opts ...request.Option) (*route53.ListTagsForResourcesOutput, error) {
+  return &route53.ListTagsForResourcesOutput{}, nil
+}
+
+func (fake *fakeRoute53) GetHealthCheckStatusWithContext(ctx aws.Context, input *route53.GetHealthCheckStatusInput, opts ...request.Option) (*route53.GetHealthCheckStatusOutput, error) {
+  return &route53.GetHealthCheckStatusOutput{HealthCheckObservations: fake.observations[aws.StringValue(input.HealthCheckId)]}, nil
+}
+
+// Answers DescribeAlarmsForMetric with one alarm per health check in the given state, after delay
+type fakeCloudWatch struct {
+  mu          sync.Mutex
+  alarmStates map[string]string
+  err         error
+  delay       time.Duration
+  calls       int
+  listCalls   int
+  inFlight    int
+  maxInFlight int
+}
+
+func (fake *fakeCloudWatch) DescribeAlarmsForMetricWithContext(ctx aws.Context, input *cloudwatch.DescribeAlarmsForMetricInput, opts ...request.Option) (*cloudwatch.DescribeAlarmsForMetricOutput, error) {
+  fake.mu.Lock()
+  fake.calls++
+  fake.inFlight++
+  if fake.inFlight > fake.maxInFlight {
+    fake.maxInFlight = fake.inFlight
+  }
+  fake.mu.Unlock()
+  defer func() {
+    fake.mu.Lock()
+    fake.inFlight--
+    fake.mu.Unlock()
+  }()
+
+  time.Sleep(fake.delay)
+  if fake.err != nil {
+    return nil, fake.err
+  }
+  if err := ctx.Err(); err != nil {
+    return nil, err
+  }
+  output := &cloudwatch.DescribeAlarmsForMetricOutput{}
+  if state, ok := fake.alarmStates[aws.StringValue(input.Dimensions[0].Value)]; ok {
+    output.MetricAlarms = []*cloudwatch.MetricAlarm{{StateValue: aws.String(state)}}
+  }
+  return output, nil
+}
+
+// Lists an alarm per health check, two per page, along with an alarm on another metric
+func (fake *fakeCloudWatch) DescribeAlarmsPagesWithContext(ctx aws.Context, input *cloudwatch.DescribeAlarmsInput, fn func(*cloudwatch.DescribeAlarmsOutput, bool) bool, opts ...request.Option) error {
+  fake.mu.Lock()
+  fake.listCalls++
+  fake.mu.Unlock()
+  if fake.err != nil {
+    return fake.err
+  }
+
+  alarms := []*cloudwatch.MetricAlarm{{
+    Namespace:  aws.String("AWS/EC2"),
+    MetricName: aws.String("CPUUtilization"),
+    Dimensions: []*cloudwatch.Dimension{{Name: aws.String("HealthCheckId"), Value: aws.String("hc-ec2")}},
+    StateValue: aws.String("ALARM"),
+  }}
+  var ids []string
+  for id := range fake.alarmStates {
+    ids = append(ids, id)
+  }
+  sort.Strings(ids)
+  for _, id := range ids {
+    alarms = append(alarms, &cloudwatch.MetricAlarm{
+      Namespace:  aws.String("AWS/Route53"),
+      MetricName: aws.String("HealthCheckStatus"),
+      Dimensions: []*cloudwatch.Dimension{{Name: aws.String("HealthCheckId"), Value: aws.String(id)}},
+      StateValue: aws.String(fake.alarmStates[id]),
+    })
+  }
+  for start := 0; start < len(alarms); start += 2 {
+    end := start + 2
+    if end > len(alarms) {
+      end = len(alarms)
+    }
+    if !fn(&cloudwatch.DescribeAlarmsOutput{MetricAlarms: alarms[start:end]}, end == len(alarms)) {
+      break
+    }
+  }
+  return nil
+}
+
+// Records uploaded objects, or fails every upload with err
+type fakeS3 struct {
+  err     error
+  objects map[string][]byte
+}
+
+func (fake *fakeS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+  // Like the SDK, fail straight away once the context has ended
+  if err := ctx.Err(); err != nil {
+    return nil, err
+  }
+  if fake.err != nil {
+    return nil, fake.err
+  }
+  body, err := ioutil.ReadAll(input.Body)
+  if err != nil {
+    return nil, err
+  }
+  if fake.objects == nil {
+    fake.objects = make(map[string][]byte)
+  }
+  fake.objects[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)] = body
+  return &s3.PutObjectOutput{}, nil
+}
+
+// A poller whose every account uses the same fake clients
+func newFakePoller(r53 *fakeRoute53, cw *fakeCloudWatch) *Poller {
+  clients := clientsWith(r53, cw)
+  return newPoller(&StateStore{}, func(account *AccountSpec) (*AWSClients, error) {
+    return clients, nil
+  }, 4, 0)
+}
+
+func recordSet(name string, recordType string, healthCheckId string) *route53.ResourceRecordSet {
+  recordSet := &route53.ResourceRecordSet{Name: aws.String(name), Type: aws.String(recordType)}
+  if healthCheckId != "" {
+    recordSet.HealthCheckId = aws.String(healthCheckId)
+  }
+  return recordSet
+}
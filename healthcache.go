@@ -0,0 +1,74 @@
+package main
+
+import (
+  "context"
+  "sync"
+  "time"
+)
+
+// Results are shared per source since the same id can read differently from another account or source
+type healthCheckKey struct {
+  source        HealthSource
+  healthCheckId string
+}
+
+type healthCheckEntry struct {
+  ready       chan struct{}
+  healthCheck HealthCheck
+}
+
+// Health check results for one cycle, shared by the workers so each health check is looked up once
+type healthCheckCache struct {
+  mu      sync.Mutex
+  entries map[healthCheckKey]*healthCheckEntry
+}
+
+// Spaces health check lookups out to stay under the health source's API rate limit
+type rateLimiter struct {
+  ticker *time.Ticker
+}
+
+func newHealthCheckCache() *healthCheckCache {
+  return &healthCheckCache{entries: make(map[healthCheckKey]*healthCheckEntry)}
+}
+
+// Returns the cached result, waiting for a lookup already in flight, or runs lookup and caches its result
+func (cache *healthCheckCache) get(source HealthSource, healthCheckId string, lookup func() HealthCheck) HealthCheck {
+  key := healthCheckKey{source: source, healthCheckId: healthCheckId}
+  cache.mu.Lock()
+  entry, ok := cache.entries[key]
+  if !ok {
+    entry = &healthCheckEntry{ready: make(chan struct{})}
+    cache.entries[key] = entry
+  }
+  cache.mu.Unlock()
+
+  if ok {
+    <-entry.ready
+    return entry.healthCheck
+  }
+  entry.healthCheck = lookup()
+  close(entry.ready)
+  return entry.healthCheck
+}
+
+// A limit of zero or less allows any rate
+func newRateLimiter(perSecond float64) *rateLimiter {
+  if perSecond <= 0 {
+    return nil
+  }
+  return &rateLimiter{ticker: time.NewTicker(time.Duration(float64(time.Second) / perSecond))}
+}
+
+// Blocks until the next call is allowed or ctx ends
+func (limiter *rateLimiter) wait(ctx context.Context) error {
+  if limiter == nil {
+    return ctx.Err()
+  }
+  select {
+  case <-limiter.ticker.C:
+    return nil
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+}
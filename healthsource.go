@@ -0,0 +1,200 @@
+package main
+
+import (
+  "context"
+  "fmt"
+  "strings"
+  "sync"
+
+  log "github.com/Sirupsen/logrus"
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/service/cloudwatch"
+  "github.com/aws/aws-sdk-go/service/route53"
+)
+
+// Where the health of a Route53 health check is read from
+type HealthSource interface {
+  GetHealthCheck(ctx context.Context, healthCheckId string) (HealthCheck, error)
+}
+
+// Reads the state of the CloudWatch alarm on the health check's HealthCheckStatus metric
+type CloudWatchHealthSource struct {
+  client CloudWatchAPI
+}
+
+// Health sources that read every health check at once, on first use in each cycle
+type BatchHealthSource interface {
+  HealthSource
+  // Drops the previous cycle's results
+  reset()
+}
+
+// Reads the same alarms as CloudWatchHealthSource, but lists all Route53 health check alarms once per cycle
+// instead of making a call per health check
+type BatchCloudWatchHealthSource struct {
+  client CloudWatchAPI
+  mu     sync.Mutex
+  loaded bool
+  states map[string]string
+  err    error
+}
+
+// Reads the latest observations of the Route53 health checkers, no alarm required
+type Route53HealthSource struct {
+  client Route53API
+}
+
+const defaultHealthSource = "cloudwatch"
+
+// Route53 considers an endpoint healthy when more than 18% of its checkers report it healthy
+const route53HealthyCheckerRatio = 0.18
+
+// Picks the service's health source, falling back to the global setting and then to CloudWatch
+func healthSourceFor(serviceConfig *ServiceConfig, serviceSpec *ServiceSpec, clients *AWSClients) (HealthSource, error) {
+  name := serviceSpec.HealthSource
+  if name == "" {
+    name = serviceConfig.HealthSource
+  }
+  if name == "" {
+    name = defaultHealthSource
+  }
+  source, ok := clients.HealthSources[name]
+  if !ok {
+    return nil, fmt.Errorf("unknown health source %q for service %s", name, serviceSpec.Name)
+  }
+  return source, nil
+}
+
+func validHealthSource(name string) bool {
+  switch name {
+  case "", "cloudwatch", "cloudwatch-batch", "route53":
+    return true
+  }
+  return false
+}
+
+func (source *CloudWatchHealthSource) GetHealthCheck(ctx context.Context, healthCheckId string) (HealthCheck, error) {
+  var healthCheck HealthCheck
+  dimensionName := "HealthCheckId"
+  metricName := "HealthCheckStatus"
+  namespace := "AWS/Route53"
+  var dimensions []*cloudwatch.Dimension
+  dimensions = append(dimensions, &cloudwatch.Dimension{Name: &dimensionName, Value: &healthCheckId})
+  alarm, err := source.client.DescribeAlarmsForMetricWithContext(ctx, &cloudwatch.DescribeAlarmsForMetricInput{Dimensions: dimensions, MetricName: &metricName, Namespace: &namespace})
+  if err != nil {
+    return healthCheck, err
+  }
+
+  if len(alarm.MetricAlarms) > 0 {
+    if aws.StringValue(alarm.MetricAlarms[0].StateValue) == "OK" {
+      healthCheck.Health = 0
+      healthCheck.Reason = ""
+    } else {
+      healthCheck.Health = 2
+      healthCheck.Reason = "Healthcheck Failing"
+    }
+  } else {
+    log.Warn("No Alarm found for healthCheckId ", healthCheckId)
+    healthCheck.Health = 1
+    healthCheck.Reason = "No Alarm Found"
+  }
+  return healthCheck, nil
+}
+
+func (source *BatchCloudWatchHealthSource) reset() {
+  source.mu.Lock()
+  defer source.mu.Unlock()
+  source.loaded, source.states, source.err = false, nil, nil
+}
+
+func (source *BatchCloudWatchHealthSource) GetHealthCheck(ctx context.Context, healthCheckId string) (HealthCheck, error) {
+  states, err := source.load(ctx)
+  if err != nil {
+    return HealthCheck{}, err
+  }
+
+  state, ok := states[healthCheckId]
+  switch {
+  case !ok:
+    log.Warn("No Alarm found for healthCheckId ", healthCheckId)
+    return HealthCheck{Health: 1, Reason: "No Alarm Found"}, nil
+  case state == "OK":
+    return HealthCheck{Health: 0, Reason: ""}, nil
+  default:
+    return HealthCheck{Health: 2, Reason: "Healthcheck Failing"}, nil
+  }
+}
+
+// Lists the alarms once per cycle; workers asking meanwhile wait for the same listing, and a failed
+// listing is not retried until the next cycle
+func (source *BatchCloudWatchHealthSource) load(ctx context.Context) (map[string]string, error) {
+  source.mu.Lock()
+  defer source.mu.Unlock()
+  if !source.loaded {
+    source.states, source.err = describeHealthCheckAlarms(ctx, source.client)
+    source.loaded = true
+  }
+  return source.states, source.err
+}
+
+// Maps each health check id to the state of its HealthCheckStatus alarm
+// DescribeAlarms can't filter by namespace, so every alarm is listed and the others skipped
+// Like DescribeAlarmsForMetric, the first alarm by name wins when a health check has several
+func describeHealthCheckAlarms(ctx context.Context, client CloudWatchAPI) (map[string]string, error) {
+  states := make(map[string]string)
+  pages := 0
+  err := client.DescribeAlarmsPagesWithContext(ctx, &cloudwatch.DescribeAlarmsInput{MaxRecords: aws.Int64(100)}, func(page *cloudwatch.DescribeAlarmsOutput, lastPage bool) bool {
+    pages++
+    for _, alarm := range page.MetricAlarms {
+      if aws.StringValue(alarm.Namespace) != "AWS/Route53" || aws.StringValue(alarm.MetricName) != "HealthCheckStatus" {
+        continue
+      }
+      for _, dimension := range alarm.Dimensions {
+        if aws.StringValue(dimension.Name) != "HealthCheckId" {
+          continue
+        }
+        if _, ok := states[aws.StringValue(dimension.Value)]; !ok {
+          states[aws.StringValue(dimension.Value)] = aws.StringValue(alarm.StateValue)
+        }
+      }
+    }
+    return true
+  })
+  if err != nil {
+    return nil, err
+  }
+  log.Debug("Read ", len(states), " health check alarms in ", pages, " pages")
+  return states, nil
+}
+
+func (source *Route53HealthSource) GetHealthCheck(ctx context.Context, healthCheckId string) (HealthCheck, error) {
+  var healthCheck HealthCheck
+  status, err := source.client.GetHealthCheckStatusWithContext(ctx, &route53.GetHealthCheckStatusInput{HealthCheckId: aws.String(healthCheckId)})
+  if err != nil {
+    return healthCheck, err
+  }
+
+  if len(status.HealthCheckObservations) == 0 {
+    log.Warn("No checker observations for healthCheckId ", healthCheckId)
+    healthCheck.Health = 1
+    healthCheck.Reason = "No Checker Observations"
+    return healthCheck, nil
+  }
+
+  healthy := 0
+  for _, observation := range status.HealthCheckObservations {
+    if observation.StatusReport != nil && strings.HasPrefix(aws.StringValue(observation.StatusReport.Status), "Success") {
+      healthy++
+    }
+  }
+
+  total := len(status.HealthCheckObservations)
+  if float64(healthy)/float64(total) > route53HealthyCheckerRatio {
+    healthCheck.Health = 0
+    healthCheck.Reason = ""
+  } else {
+    healthCheck.Health = 2
+    healthCheck.Reason = fmt.Sprintf("Healthcheck Failing (%d of %d checkers healthy)", healthy, total)
+  }
+  return healthCheck, nil
+}
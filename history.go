@@ -0,0 +1,272 @@
+package main
+
+import (
+  "bufio"
+  "encoding/json"
+  "io/ioutil"
+  "math"
+  "os"
+  "path/filepath"
+  "sort"
+  "sync"
+  "time"
+
+  log "github.com/Sirupsen/logrus"
+)
+
+// A change in health of an environment, or of an instance when Instance is set
+type Transition struct {
+  Time        int64
+  Service     string
+  Environment string
+  Instance    string `json:",omitempty"`
+  Health      int
+  Reason      string
+}
+
+// Append-only log of transitions, one JSON object per line
+// Only the retention window is kept, plus the last transition before it so every window has a starting state
+type HistoryStore struct {
+  mu          sync.Mutex
+  path        string
+  file        *os.File
+  transitions []Transition
+  current     map[string]Transition
+  dropped     int
+}
+
+const historyRetention = 30 * 24 * time.Hour
+
+var uptimeWindows = []struct {
+  Name     string
+  Duration time.Duration
+}{
+  {"24h", 24 * time.Hour},
+  {"7d", 7 * 24 * time.Hour},
+  {"30d", 30 * 24 * time.Hour},
+}
+
+var history *HistoryStore
+
+func openHistoryStore(path string) (*HistoryStore, error) {
+  store := &HistoryStore{path: path, current: make(map[string]Transition)}
+
+  file, err := os.Open(path)
+  if err != nil && !os.IsNotExist(err) {
+    return nil, err
+  }
+  if err == nil {
+    scanner := bufio.NewScanner(file)
+    line := 0
+    for scanner.Scan() {
+      line++
+      var transition Transition
+      if err := json.Unmarshal(scanner.Bytes(), &transition); err != nil {
+        // A crash mid-write can leave a partial last line behind
+        log.Warn("Skipping unreadable history line ", line, " in ", path, "; ", err)
+        continue
+      }
+      store.add(transition)
+    }
+    file.Close()
+    if err := scanner.Err(); err != nil {
+      return nil, err
+    }
+  }
+
+  store.prune(time.Now())
+  if err := store.compact(); err != nil {
+    return nil, err
+  }
+  return store, nil
+}
+
+func historyKey(service string, environment string, instance string) string {
+  return service + "\x00" + environment + "\x00" + instance
+}
+
+func (store *HistoryStore) add(transition Transition) {
+  store.transitions = append(store.transitions, transition)
+  store.current[historyKey(transition.Service, transition.Environment, transition.Instance)] = transition
+}
+
+// Records the health changes between the stored state and this snapshot
+func (store *HistoryStore) Record(services map[string]Service, now time.Time) error {
+  store.mu.Lock()
+  defer store.mu.Unlock()
+
+  transitions := stateTransitions(store.current, services, now)
+  if len(transitions) > 0 {
+    writer := bufio.NewWriter(store.file)
+    encoder := json.NewEncoder(writer)
+    for _, transition := range transitions {
+      store.add(transition)
+      if err := encoder.Encode(transition); err != nil {
+        return err
+      }
+    }
+    if err := writer.Flush(); err != nil {
+      return err
+    }
+  }
+
+  store.prune(now)
+  if store.dropped > len(store.transitions) {
+    return store.compact()
+  }
+  return nil
+}
+
+// Lists the environments and instances whose health differs from current
+// Instances sharing a name are tracked as one, at the worst health among them
+func stateTransitions(current map[string]Transition, services map[string]Service, now time.Time) []Transition {
+  serviceNames := make([]string, 0, len(services))
+  for name := range services {
+    serviceNames = append(serviceNames, name)
+  }
+  sort.Strings(serviceNames)
+
+  var transitions []Transition
+  check := func(transition Transition) {
+    previous, ok := current[historyKey(transition.Service, transition.Environment, transition.Instance)]
+    if !ok || previous.Health != transition.Health {
+      transitions = append(transitions, transition)
+    }
+  }
+  for _, serviceName := range serviceNames {
+    for _, environment := range services[serviceName].Environments {
+      check(Transition{Time: now.Unix(), Service: serviceName, Environment: environment.Name, Health: environment.Health, Reason: environment.Reason})
+      names, instances := instancesByName(&environment)
+      for _, name := range names {
+        instance := instances[name]
+        check(Transition{Time: now.Unix(), Service: serviceName, Environment: environment.Name, Instance: name, Health: instance.Health, Reason: instance.Reason})
+      }
+    }
+  }
+  return transitions
+}
+
+// Groups instances by name in first-seen order, keeping the least healthy of any duplicates
+func instancesByName(environment *Environment) ([]string, map[string]Instance) {
+  var names []string
+  instances := make(map[string]Instance)
+  for _, instance := range environment.Instances {
+    existing, seen := instances[instance.Name]
+    if !seen {
+      names = append(names, instance.Name)
+    }
+    if !seen || instance.Health > existing.Health {
+      instances[instance.Name] = instance
+    }
+  }
+  return names, instances
+}
+
+// Drops transitions older than the retention window, except the latest one per key
+func (store *HistoryStore) prune(now time.Time) {
+  cutoff := now.Add(-historyRetention).Unix()
+  if len(store.transitions) == 0 || store.transitions[0].Time >= cutoff {
+    return
+  }
+
+  latestBefore := make(map[string]int)
+  for i, transition := range store.transitions {
+    if transition.Time < cutoff {
+      latestBefore[historyKey(transition.Service, transition.Environment, transition.Instance)] = i
+    }
+  }
+  kept := store.transitions[:0]
+  for i, transition := range store.transitions {
+    key := historyKey(transition.Service, transition.Environment, transition.Instance)
+    if transition.Time >= cutoff || latestBefore[key] == i {
+      kept = append(kept, transition)
+    } else {
+      store.dropped++
+    }
+  }
+  store.transitions = kept
+}
+
+// Rewrites the history file with only the retained transitions
+func (store *HistoryStore) compact() error {
+  tmp, err := ioutil.TempFile(filepath.Dir(store.path), "."+filepath.Base(store.path))
+  if err != nil {
+    return err
+  }
+  writer := bufio.NewWriter(tmp)
+  encoder := json.NewEncoder(writer)
+  for _, transition := range store.transitions {
+    if err := encoder.Encode(transition); err != nil {
+      tmp.Close()
+      os.Remove(tmp.Name())
+      return err
+    }
+  }
+  if err := writer.Flush(); err != nil {
+    tmp.Close()
+    os.Remove(tmp.Name())
+    return err
+  }
+  if err := tmp.Close(); err != nil {
+    os.Remove(tmp.Name())
+    return err
+  }
+  if err := os.Rename(tmp.Name(), store.path); err != nil {
+    os.Remove(tmp.Name())
+    return err
+  }
+
+  if store.file != nil {
+    store.file.Close()
+  }
+  store.file, err = os.OpenFile(store.path, os.O_APPEND|os.O_WRONLY, 0644)
+  store.dropped = 0
+  return err
+}
+
+// Percentage of each window an environment was up, keyed by window name
+// Failing (2) counts as down; time without a known status (3) or before the first record is left out
+func (store *HistoryStore) Uptime(service string, environment string, now time.Time) map[string]float64 {
+  store.mu.Lock()
+  defer store.mu.Unlock()
+
+  var transitions []Transition
+  for _, transition := range store.transitions {
+    if transition.Service == service && transition.Environment == environment && transition.Instance == "" {
+      transitions = append(transitions, transition)
+    }
+  }
+  if len(transitions) == 0 {
+    return nil
+  }
+
+  uptime := make(map[string]float64)
+  for _, window := range uptimeWindows {
+    start := now.Add(-window.Duration).Unix()
+    var up, known int64
+    for i, transition := range transitions {
+      end := now.Unix()
+      if i+1 < len(transitions) {
+        end = transitions[i+1].Time
+      }
+      from := transition.Time
+      if from < start {
+        from = start
+      }
+      if end <= from {
+        continue
+      }
+      if transition.Health == 3 {
+        continue
+      }
+      known += end - from
+      if transition.Health < 2 {
+        up += end - from
+      }
+    }
+    if known > 0 {
+      uptime[window.Name] = math.Round(float64(up)*100000/float64(known)) / 1000
+    }
+  }
+  return uptime
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "reflect"
+  "strconv"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestUptime(t *testing.T) {
+  now := time.Date(2018, 9, 1, 12, 0, 0, 0, time.UTC)
+  at := func(ago time.Duration, health int) Transition {
+    return Transition{Time: now.Add(-ago).Unix(), Service: "api", Environment: "prod", Health: health}
+  }
+  day := 24 * time.Hour
+
+  tests := []struct {
+    name        string
+    transitions []Transition
+    prune       bool
+    want        map[string]float64
+  }{
+    {"no history", nil, false, nil},
+    {"always up", []Transition{at(40*day, 0)}, false, map[string]float64{"24h": 100, "7d": 100, "30d": 100}},
+    {"window starts mid-transition", []Transition{at(48*time.Hour, 2), at(12*time.Hour, 0)}, false,
+      map[string]float64{"24h": 50, "7d": 25, "30d": 25}},
+    {"unknown health left out", []Transition{at(24*time.Hour, 0), at(12*time.Hour, 3), at(6*time.Hour, 2)}, false,
+      map[string]float64{"24h": 66.667, "7d": 66.667, "30d": 66.667}},
+    {"warning counts as up", []Transition{at(24*time.Hour, 1), at(12*time.Hour, 2)}, false,
+      map[string]float64{"24h": 50, "7d": 50, "30d": 50}},
+    {"only unknown", []Transition{at(day, 3)}, false, map[string]float64{}},
+    {"other environments and instances ignored", []Transition{
+      at(day, 0),
+      {Time: now.Add(-12 * time.Hour).Unix(), Service: "api", Environment: "prod", Instance: "us-east-1", Health: 2},
+      {Time: now.Add(-12 * time.Hour).Unix(), Service: "api", Environment: "stage", Health: 2},
+    }, false, map[string]float64{"24h": 100, "7d": 100, "30d": 100}},
+    // The transition at 35 days is the latest before the cutoff, so it still sets the state the 30d window starts in
+    {"latest before cutoff retained", []Transition{at(40*day, 2), at(35*day, 0), at(day, 2)}, true,
+      map[string]float64{"24h": 0, "7d": 85.714, "30d": 96.667}},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      store := &HistoryStore{current: make(map[string]Transition)}
+      for _, transition := range test.transitions {
+        store.add(transition)
+      }
+      if test.prune {
+        store.prune(now)
+      }
+      if got := store.Uptime("api", "prod", now); !reflect.DeepEqual(got, test.want) {
+        t.Errorf("uptime = %v, want %v", got, test.want)
+      }
+    })
+  }
+}
+
+func TestHistoryPrune(t *testing.T) {
+  now := time.Date(2018, 9, 1, 12, 0, 0, 0, time.UTC)
+  old := now.Add(-historyRetention - time.Hour).Unix()
+  store := &HistoryStore{current: make(map[string]Transition)}
+  for _, transition := range []Transition{
+    {Time: old - 60, Service: "api", Environment: "prod", Health: 2},
+    {Time: old - 60, Service: "api", Environment: "stage", Health: 0},
+    {Time: old, Service: "api", Environment: "prod", Health: 0},
+    {Time: now.Unix(), Service: "api", Environment: "prod", Health: 2},
+  } {
+    store.add(transition)
+  }
+
+  store.prune(now)
+
+  want := []Transition{
+    {Time: old - 60, Service: "api", Environment: "stage", Health: 0},
+    {Time: old, Service: "api", Environment: "prod", Health: 0},
+    {Time: now.Unix(), Service: "api", Environment: "prod", Health: 2},
+  }
+  if !reflect.DeepEqual(store.transitions, want) {
+    t.Errorf("kept %+v, want %+v", store.transitions, want)
+  }
+  if store.dropped != 1 {
+    t.Errorf("dropped = %d, want 1", store.dropped)
+  }
+}
+
+func TestOpenHistoryStore(t *testing.T) {
+  dir, err := ioutil.TempDir("", "history")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "history.jsonl")
+
+  now := time.Now().Truncate(time.Second)
+  recent := now.Add(-time.Hour).Unix()
+  // A crash mid-write left the last line unfinished
+  content := `{"Time":` + strconv.FormatInt(recent, 10) + `,"Service":"api","Environment":"prod","Health":0,"Reason":""}` + "\n" +
+    `{"Time":` + strconv.FormatInt(recent+60, 10) + `,"Service":"api","Environment":"prod","Instance":"us-east-1","Health":2,"Reason":"Healthcheck Failing"}` + "\n" +
+    `{"Time":` + strconv.FormatInt(recent+120, 10) + `,"Servi`
+  if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+    t.Fatal(err)
+  }
+
+  store, err := openHistoryStore(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(store.transitions) != 2 {
+    t.Fatalf("read %d transitions, want the 2 complete lines", len(store.transitions))
+  }
+  if current := store.current[historyKey("api", "prod", "us-east-1")]; current.Health != 2 {
+    t.Errorf("instance health = %d, want 2", current.Health)
+  }
+
+  // The partial line is compacted away, so later records start on a line of their own
+  services := map[string]Service{"api": {Environments: []Environment{{Name: "prod", Health: 2, Reason: "Healthcheck Failing"}}}}
+  if err := store.Record(services, now); err != nil {
+    t.Fatal(err)
+  }
+  store.file.Close()
+
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 3 {
+    t.Errorf("history file has %d lines, want 3:\n%s", len(lines), data)
+  }
+
+  reopened, err := openHistoryStore(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer reopened.file.Close()
+  if !reflect.DeepEqual(reopened.transitions, store.transitions) {
+    t.Errorf("reopened %+v, want %+v", reopened.transitions, store.transitions)
+  }
+  if uptime := reopened.Uptime("api", "prod", now); uptime["24h"] != 100 {
+    t.Errorf("24h uptime = %v, want 100 until the failure just recorded", uptime["24h"])
+  }
+}
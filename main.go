@@ -1,20 +1,17 @@
 package main
 
 import (
-  "bytes"
+  "context"
   "encoding/json"
-  "io/ioutil"
   "time"
   "os"
+  "os/signal"
+  "strings"
+  "syscall"
 
   log "github.com/Sirupsen/logrus"
   "github.com/aws/aws-sdk-go/aws"
-  "github.com/aws/aws-sdk-go/aws/awserr"
-  "github.com/aws/aws-sdk-go/aws/credentials"
-  "github.com/aws/aws-sdk-go/aws/session"
-  "github.com/aws/aws-sdk-go/service/cloudwatch"
   "github.com/aws/aws-sdk-go/service/route53"
-  "github.com/aws/aws-sdk-go/service/s3"
   envconfig "github.com/kelseyhightower/envconfig"
 )
 
@@ -22,6 +19,9 @@ type ServiceSpec struct {
   Name             string
   DisplayName      string
   S3DataPath       string
+  HealthSource     string
+  Account          *AccountSpec `json:",omitempty"`
+  Webhooks         []WebhookSpec
   EnvironmentSpecs []EnvironmentSpec `json:"Environments"`
 }
 
@@ -35,6 +35,9 @@ type EnvironmentSpec struct {
   Name         string
   HostedZoneId string
   DomainName   string
+  RecordTypes  []string
+  Aggregation  AggregationSpec
+  Account      *AccountSpec `json:",omitempty"`
 }
 
 type Environment struct {
@@ -43,30 +46,59 @@ type Environment struct {
   AsOfTime  int32
   Health    int
   Reason    string
+  Uptime    map[string]float64 `json:",omitempty"`
 }
 
 type Instance struct {
-  Name   string
-  Health int
-  Reason string
+  Name          string
+  Health        int
+  Reason        string
+  Policy        string
+  SetIdentifier string `json:",omitempty"`
+  Region        string `json:",omitempty"`
+  Weight        *int64 `json:",omitempty"`
+  Failover      string `json:",omitempty"`
+  GeoLocation   string `json:",omitempty"`
 }
 
 
 type EnvConfig struct {
-  AwsAccessKeyIdFetch     string `envconfig:"AWS_ACCESS_KEY_ID_FETCH"`
-  AwsSecretAccessKeyFetch string `envconfig:"AWS_SECRET_ACCESS_KEY_FETCH"`
-  AwsAccessKeyIdPost      string `envconfig:"AWS_ACCESS_KEY_ID_POST"`
-  AwsSecretAccessKeyPost  string `envconfig:"AWS_SECRET_ACCESS_KEY_POST"`
-  ConfigPath              string `envconfig:"CONFIG_PATH"`
-  AwsDebug                bool   `envconfig:"AWS_DEBUG"`
-  PostIntervalSec         int32  `envconfig:"POST_INTERVAL_SEC" default:"30"`
-  Route53IntervalSec      int32  `envconfig:"ROUTE53_INTERVAL_SEC" default:"30"`
+  AwsAccessKeyIdFetch     string  `envconfig:"AWS_ACCESS_KEY_ID_FETCH"`
+  AwsSecretAccessKeyFetch string  `envconfig:"AWS_SECRET_ACCESS_KEY_FETCH"`
+  AwsAccessKeyIdPost      string  `envconfig:"AWS_ACCESS_KEY_ID_POST"`
+  AwsSecretAccessKeyPost  string  `envconfig:"AWS_SECRET_ACCESS_KEY_POST"`
+  AwsProfileFetch         string  `envconfig:"AWS_PROFILE_FETCH"`
+  AwsProfilePost          string  `envconfig:"AWS_PROFILE_POST"`
+  AwsRoleArnFetch         string  `envconfig:"AWS_ROLE_ARN_FETCH"`
+  AwsRoleArnPost          string  `envconfig:"AWS_ROLE_ARN_POST"`
+  AwsExternalIdFetch      string  `envconfig:"AWS_EXTERNAL_ID_FETCH"`
+  AwsExternalIdPost       string  `envconfig:"AWS_EXTERNAL_ID_POST"`
+  ConfigPath              string  `envconfig:"CONFIG_PATH"`
+  AwsDebug                bool    `envconfig:"AWS_DEBUG"`
+  PostIntervalSec         int32   `envconfig:"POST_INTERVAL_SEC" default:"30"`
+  Route53IntervalSec      int32   `envconfig:"ROUTE53_INTERVAL_SEC" default:"30"`
+  HttpListenAddr          string  `envconfig:"HTTP_LISTEN_ADDR"`
+  HistoryPath             string  `envconfig:"HISTORY_PATH"`
+  AwsRegion               string  `envconfig:"AWS_REGION" default:"us-east-1"`
+  S3Region                string  `envconfig:"S3_REGION"`
+  Route53Endpoint         string  `envconfig:"ROUTE53_ENDPOINT"`
+  CloudWatchEndpoint      string  `envconfig:"CLOUDWATCH_ENDPOINT"`
+  S3Endpoint              string  `envconfig:"S3_ENDPOINT"`
+  S3ForcePathStyle        bool    `envconfig:"S3_FORCE_PATH_STYLE"`
+  CycleTimeoutSec         int32   `envconfig:"CYCLE_TIMEOUT_SEC"`
+  ShutdownTimeoutSec      int32   `envconfig:"SHUTDOWN_TIMEOUT_SEC" default:"20"`
+  PollConcurrency         int     `envconfig:"POLL_CONCURRENCY" default:"8"`
+  HealthCheckRateLimit    float64 `envconfig:"HEALTH_CHECK_RATE_LIMIT"`
+  ZoneCachePath           string  `envconfig:"ZONE_CACHE_PATH"`
 }
 
 type ServiceConfig struct {
-  S3BucketPost string        `json:"S3BucketPost"`
-  S3MainPath   string        `json:S3MainPath`
-  ServiceSpecs []ServiceSpec `json:"Services"`
+  S3BucketPost string         `json:"S3BucketPost"`
+  S3MainPath   string         `json:"S3MainPath"`
+  HealthSource string         `json:"HealthSource"`
+  Discovery    *DiscoverySpec `json:"Discovery"`
+  Sinks        []SinkSpec     `json:"Sinks"`
+  ServiceSpecs []ServiceSpec  `json:"Services"`
 }
 
 type HealthCheck struct {
@@ -75,16 +107,14 @@ type HealthCheck struct {
 }
 
 var CONFIG EnvConfig
-var SERVICE_CONFIG ServiceConfig
-var cw *cloudwatch.CloudWatch
-var r53 *route53.Route53
-var s3service *s3.S3
-var healthChecks map[string]HealthCheck
-var cachedHostedZones map[string][]*route53.ResourceRecordSet
-var services []Service
+var poller *Poller
 
 func main() {
 
+  if len(os.Args) > 1 && os.Args[1] == "validate" {
+    os.Exit(runValidate(os.Args[2:]))
+  }
+
   log.SetLevel(log.DebugLevel)
   log.SetOutput(os.Stdout)
 
@@ -101,14 +131,14 @@ func main() {
     log.Error("Post interval must be at least 10 second, setting to 10")
     CONFIG.PostIntervalSec = 10;
   }
-
-
-  // Read config file
-  config, err := ioutil.ReadFile(CONFIG.ConfigPath)
-  if err != nil {
-    log.Fatal("Error loading config file: ", CONFIG.ConfigPath)
+  if CONFIG.PollConcurrency < 1 {
+    log.Error("Poll concurrency must be at least 1, setting to 1")
+    CONFIG.PollConcurrency = 1
+  }
+  if CONFIG.CycleTimeoutSec <= 0 {
+    CONFIG.CycleTimeoutSec = CONFIG.PostIntervalSec
   }
-  json.Unmarshal(config, &SERVICE_CONFIG)
+
 
   // Set AWS log level
   awsLogLevel := aws.LogOff
@@ -116,188 +146,237 @@ func main() {
     awsLogLevel = aws.LogDebugWithHTTPBody
   }
 
+  // Route53 health check metrics and alarms only exist in us-east-1 (or the partition's equivalent)
+  awsConfig := &aws.Config{Region: aws.String(CONFIG.AwsRegion), LogLevel: aws.LogLevel(awsLogLevel)}
+  fetchConfig = awsConfig
+
   // Session for pulling status info
-  fetchCreds := credentials.NewStaticCredentials(CONFIG.AwsAccessKeyIdFetch, CONFIG.AwsSecretAccessKeyFetch, "")
-  sessFetch, err := session.NewSession(&aws.Config{Credentials: fetchCreds, Region: aws.String("us-east-1"), LogLevel: aws.LogLevel(awsLogLevel)})
+  sessFetch, err = newAWSSession(CredentialSpec{
+    AccessKeyId:     CONFIG.AwsAccessKeyIdFetch,
+    SecretAccessKey: CONFIG.AwsSecretAccessKeyFetch,
+    Profile:         CONFIG.AwsProfileFetch,
+    RoleArn:         CONFIG.AwsRoleArnFetch,
+    ExternalId:      CONFIG.AwsExternalIdFetch,
+  }, awsConfig)
+  if err != nil {
+    log.Fatal("Error creating AWS fetch session", err)
+  }
 
   // Session for pushing status to S3
-  postCreds := credentials.NewStaticCredentials(CONFIG.AwsAccessKeyIdPost, CONFIG.AwsSecretAccessKeyPost, "")
-  sessPost, err := session.NewSession(&aws.Config{Region: aws.String("us-east-1"), Credentials: postCreds, LogLevel: aws.LogLevel(awsLogLevel)})
+  sessPost, err = newAWSSession(CredentialSpec{
+    AccessKeyId:     CONFIG.AwsAccessKeyIdPost,
+    SecretAccessKey: CONFIG.AwsSecretAccessKeyPost,
+    Profile:         CONFIG.AwsProfilePost,
+    RoleArn:         CONFIG.AwsRoleArnPost,
+    ExternalId:      CONFIG.AwsExternalIdPost,
+  }, awsConfig)
+  if err != nil {
+    log.Fatal("Error creating AWS post session", err)
+  }
+
+  instrumentSession(sessFetch)
+  instrumentSession(sessPost)
+
+  defaultClients = newAWSClients(sessFetch)
 
+  // Read config file
+  config, err := loadConfig(CONFIG.ConfigPath)
   if err != nil {
-    log.Fatal("Error creating AWS session", err)
+    log.Fatal("Error loading config file: ", CONFIG.ConfigPath, "; ", err)
+  }
+  state.storeConfig(config)
+  log.SetOutput(logOutput(config.Sinks))
+  go watchConfig(CONFIG.ConfigPath)
+
+  if CONFIG.HistoryPath != "" {
+    history, err = openHistoryStore(CONFIG.HistoryPath)
+    if err != nil {
+      log.Fatal("Error opening history store: ", CONFIG.HistoryPath, "; ", err)
+    }
+  }
+
+  notifier = newNotifier()
+
+  poller = newPoller(state, clientsFor, CONFIG.PollConcurrency, CONFIG.HealthCheckRateLimit)
+  if CONFIG.ZoneCachePath != "" {
+    // A damaged cache only costs the warm start
+    if err := poller.warmStart(CONFIG.ZoneCachePath); err != nil {
+      log.Warn("Unable to read hosted zone cache ", CONFIG.ZoneCachePath, "; ", err)
+    }
+  }
+
+  if CONFIG.HttpListenAddr != "" {
+    startHTTPServer(CONFIG.HttpListenAddr)
   }
 
-  r53 = route53.New(sessFetch)
-  cw = cloudwatch.New(sessFetch)
-  s3service = s3.New(sessPost)
+  // stopping ends the polling loops; draining additionally cancels the in-flight cycle
+  stopping, stop := context.WithCancel(context.Background())
+  draining, drain := context.WithCancel(context.Background())
+  go handleShutdown(stop, drain)
 
-  go checkRoute53()
-  time.Sleep(time.Duration(5)*time.Second)
-  run()
+  go checkRoute53(stopping)
+  select {
+  case <-poller.ready:
+  case <-stopping.Done():
+  }
+  if stopping.Err() == nil {
+    run(stopping, draining)
+  }
+  log.Info("Shut down")
 }
 
-func checkRoute53() {
+// On SIGTERM or SIGINT, lets the in-flight cycle and its upload finish until SHUTDOWN_TIMEOUT_SEC has
+// passed or a second signal arrives
+func handleShutdown(stop context.CancelFunc, drain context.CancelFunc) {
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+  received := <-signals
+  log.Info("Received ", received, ", shutting down after the current cycle")
+  stop()
+
+  select {
+  case <-time.After(time.Duration(CONFIG.ShutdownTimeoutSec) * time.Second):
+    log.Warn("Shutdown deadline passed, abandoning the current cycle")
+  case received = <-signals:
+    log.Warn("Received ", received, " again, abandoning the current cycle")
+  }
+  drain()
+}
+
+func checkRoute53(stopping context.Context) {
   sleepInt := time.Duration(CONFIG.Route53IntervalSec) * time.Second
   for {
-    localHostedZones := make(map[string][]*route53.ResourceRecordSet)
-    for _, serviceSpec := range SERVICE_CONFIG.ServiceSpecs {
-      for _, envSpec := range serviceSpec.EnvironmentSpecs {
-        if _, ok := localHostedZones[envSpec.HostedZoneId]; !ok {
-          records, err := fetchHostedZone(envSpec.HostedZoneId)
-          if err == nil {
-            localHostedZones[envSpec.HostedZoneId] = records
-          }
-        }
-      }
+    // A refresh may take at most one interval, lengthened while throttled, so a hung call can't hold
+    // on to stale zones forever; zones not read by then keep their previous records
+    ctx, cancel := context.WithTimeout(stopping, poller.refreshInterval(sleepInt))
+    poller.refreshHostedZones(ctx, currentConfig().Service)
+    cancel()
+    interval := poller.refreshInterval(sleepInt)
+    if interval != sleepInt {
+      log.Warning("Route53 refresh interval lengthened to ", interval, " while throttled")
+    }
+    select {
+    case <-time.After(interval):
+    case <-configReloaded:
+    case <-stopping.Done():
+      return
     }
-    cachedHostedZones = localHostedZones
-    time.Sleep(sleepInt)
   }
 }
 
-func run() {
+func run(stopping context.Context, draining context.Context) {
   sleepInt := time.Duration(CONFIG.PostIntervalSec) * time.Second
+  cycleTimeout := time.Duration(CONFIG.CycleTimeoutSec) * time.Second
   for {
-    if len(cachedHostedZones) > 0 {
-      var services = make(map[string]Service)
-
-      for _, serviceSpec := range SERVICE_CONFIG.ServiceSpecs {
-        healthChecks = make(map[string]HealthCheck)
-        log.Debug("ServiceSpec.Name: ", serviceSpec.Name)
-        services[serviceSpec.Name] = getService(&serviceSpec)
-      }
-
-      output, err := json.Marshal(services)
-      if err != nil {
-        log.Error("Unable to create JSON output", err)
-      }
-      go postToS3(output)
-    } else {
-      log.Error("Not updating Json, No host routes found!")
+    ctx, cancel := context.WithTimeout(draining, cycleTimeout)
+    runCycle(ctx, draining, cycleTimeout)
+    cancel()
+    select {
+    case <-time.After(sleepInt):
+    case <-stopping.Done():
+      return
     }
-    time.Sleep(sleepInt)
   }
 }
 
-func getService(serviceSpec *ServiceSpec) Service {
-  service := Service{Name: serviceSpec.Name, DisplayName: serviceSpec.DisplayName}
-  for _, environmentSpec := range serviceSpec.EnvironmentSpecs {
-    environment := Environment{Name: environmentSpec.Name, Health: 3, Reason: "No Health Status Found"}
-    getEnvironment(&environmentSpec, &environment)
-    service.Environments = append(service.Environments, environment)
-  }
-  return service
-}
+// Evaluates every service, giving up on calls still running when ctx ends, then publishes the result
+// Publishing gets its own publishTimeout from draining, so a cycle that ran out of time still reports it
+func runCycle(ctx context.Context, draining context.Context, publishTimeout time.Duration) {
+  if len(state.Zones().Zones) > 0 {
+    config := currentConfig()
+    serviceSpecs := mergeServiceSpecs(config.Service.ServiceSpecs, state.DiscoveredServices())
+    services := poller.poll(ctx, config.Service, serviceSpecs)
 
-func getEnvironment(environmentSpec *EnvironmentSpec, environment *Environment) {
+    if history != nil {
+      recordHistory(services)
+    }
+    notifier.Notify(serviceSpecs, services, time.Now())
 
-  records := cachedHostedZones[environmentSpec.HostedZoneId]
-  for _, recordSet := range records {
-    if aws.StringValue(recordSet.Name) == environmentSpec.DomainName+"." && aws.StringValue(recordSet.Type) == "A" {
-      setInstance(environment, recordSet)
+    output, err := json.Marshal(services)
+    if err != nil {
+      log.Error("Unable to create JSON output", err)
     }
+    storeSnapshot(services, output)
+
+    publishCtx, cancel := context.WithTimeout(draining, publishTimeout)
+    publish(publishCtx, config.Sinks, output)
+    cancel()
+  } else {
+    log.Error("Not updating Json, No host routes found!")
   }
-  environment.AsOfTime = int32(time.Now().Unix())
 }
 
-// Fetches all recordsets from hosted zone either from AWS or from local cache
-// Caches due to AWS limits on Route53 API requests
-// Returns pointer to all recordsets
-func fetchHostedZone(hostedZoneId string) (records []*route53.ResourceRecordSet, err error) {
-
-  log.Debug("Hosted zone ", hostedZoneId, "; Making call to Route53")
-  listResourceRecordSetsInput := route53.ListResourceRecordSetsInput{HostedZoneId: &hostedZoneId}
-  result, err := r53.ListResourceRecordSets(&listResourceRecordSetsInput)
-
-  if err != nil {
-    if aerr, ok := err.(awserr.Error); ok {
-      if aerr.Code() == "Throttling" {
-        // Route53 has low throttling thresholds so ignore if being throttled
-        log.Warning("ListResourceRecordSets rate throttled")
-      } else {
-        log.Warning("Error calling ListResourceRecordSets", err)
-        return nil, err
-      }
-    } else {
-      log.Warning("Error calling ListResourceRecordSets", err)
-      return nil, err
+// Records this run's transitions and adds rolling uptime to each environment
+func recordHistory(services map[string]Service) {
+  now := time.Now()
+  if err := history.Record(services, now); err != nil {
+    log.Error("Unable to record health history; ", err)
+  }
+  for name, service := range services {
+    for i := range service.Environments {
+      service.Environments[i].Uptime = history.Uptime(name, service.Environments[i].Name, now)
     }
   }
-  return result.ResourceRecordSets, nil
 }
 
-func setInstance(environment *Environment, recordSet *route53.ResourceRecordSet) {
-
-  instance := Instance{Name: aws.StringValue(recordSet.Region)}
-  healthCheckId := aws.StringValue(recordSet.HealthCheckId)
-
-  if healthCheckId != "" {
-
-    // If we already checked this healthcheck's alarm, just use that value
-    if _, ok := healthChecks[healthCheckId]; ok {
-      instance.Health = healthChecks[healthCheckId].Health
-      instance.Reason = healthChecks[healthCheckId].Reason
-    } else {
-      dimensionName := "HealthCheckId"
-      metricName := "HealthCheckStatus"
-      namespace := "AWS/Route53"
-      var dimensions []*cloudwatch.Dimension
-      dimensions = append(dimensions, &cloudwatch.Dimension{Name: &dimensionName, Value: &healthCheckId})
-      alarm, err := cw.DescribeAlarmsForMetric(&cloudwatch.DescribeAlarmsForMetricInput{Dimensions: dimensions, MetricName: &metricName, Namespace: &namespace})
-      if err != nil {
-        log.Fatal("Error calling DescribeAlarmsForMetric", err)
-      }
-
-      if len(alarm.MetricAlarms) > 0 {
-        if aws.StringValue(alarm.MetricAlarms[0].StateValue) == "OK" {
-          instance.Health = 0
-          instance.Reason = ""
-        } else {
-          instance.Health = 2
-          instance.Reason = "Healthcheck Failing"
-        }
-      } else {
-        log.Warn("No Alarm found for healthCheckId ", healthCheckId)
-        instance.Health = 1
-        instance.Reason = "No Alarm Found"
-      }
-
-      // Add the healthcheck result to the list so we don't have to check it again on this run
-      healthChecks[healthCheckId] = HealthCheck{Health: instance.Health, Reason: instance.Reason}
-    }
-  } else {
-    log.Warn("No Healthcheck found for record set ", aws.StringValue(recordSet.Name), " ", aws.StringValue(recordSet.Region))
-    instance.Health = 1
-    instance.Reason = "No Healthcheck Found"
+// Describes a record set by its routing policy
+// Latency records keep their region as the name; other policies use the set identifier
+func newInstance(recordSet *route53.ResourceRecordSet) Instance {
+  instance := Instance{
+    SetIdentifier: aws.StringValue(recordSet.SetIdentifier),
+    Region:        aws.StringValue(recordSet.Region),
+    Weight:        recordSet.Weight,
+    Failover:      aws.StringValue(recordSet.Failover),
   }
 
-  if instance.Health < environment.Health {
-    environment.Health = instance.Health
-    environment.Reason = instance.Reason
+  switch {
+  case instance.Region != "":
+    instance.Policy = "latency"
+  case instance.Weight != nil:
+    instance.Policy = "weighted"
+  case instance.Failover != "":
+    instance.Policy = "failover"
+  case recordSet.GeoLocation != nil:
+    instance.Policy = "geolocation"
+    instance.GeoLocation = geoLocationCode(recordSet.GeoLocation)
+  case aws.BoolValue(recordSet.MultiValueAnswer):
+    instance.Policy = "multivalue"
+  default:
+    instance.Policy = "simple"
   }
 
-  environment.Instances = append(environment.Instances, instance)
+  switch {
+  case instance.Region != "":
+    instance.Name = instance.Region
+  case instance.SetIdentifier != "":
+    instance.Name = instance.SetIdentifier
+  default:
+    instance.Name = strings.TrimSuffix(aws.StringValue(recordSet.Name), ".")
+  }
+  return instance
 }
 
-func postToS3(json []byte) {
-
-  putObjectInput := s3.PutObjectInput{
-    Bucket:      aws.String(SERVICE_CONFIG.S3BucketPost),
-    Key:         &SERVICE_CONFIG.S3MainPath,
-    Body:        bytes.NewReader(json),
-    ContentType: aws.String("application/json"),
+// Formats a geolocation as CONTINENT, COUNTRY or COUNTRY-SUBDIVISION; "*" is the default location
+func geoLocationCode(geoLocation *route53.GeoLocation) string {
+  if country := aws.StringValue(geoLocation.CountryCode); country != "" {
+    if subdivision := aws.StringValue(geoLocation.SubdivisionCode); subdivision != "" {
+      return country + "-" + subdivision
+    }
+    return country
   }
+  return aws.StringValue(geoLocation.ContinentCode)
+}
 
-  _, err := s3service.PutObject(&putObjectInput)
+// Route53 returns zone ids both bare and as /hostedzone/ID
+func trimHostedZoneId(hostedZoneId string) string {
+  return strings.TrimPrefix(hostedZoneId, "/hostedzone/")
+}
 
-  if err != nil {
-    if aerr, ok := err.(awserr.Error); ok {
-      log.Info(aerr.Code())
+func containsString(values []string, value string) bool {
+  for _, v := range values {
+    if v == value {
+      return true
     }
-    log.Fatal("Error uploading stats to S3; ", err)
   }
-
-  log.Info("Successfully posted data to s3: ", SERVICE_CONFIG.S3BucketPost, "/", SERVICE_CONFIG.S3MainPath)
+  return false
 }
-
@@ -0,0 +1,44 @@
+package main
+
+import (
+  "context"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/aws/aws-sdk-go/service/route53"
+)
+
+// A cycle that runs out of time still publishes its timed out snapshot
+func TestRunCyclePublishesAfterTimeout(t *testing.T) {
+  cw := &fakeCloudWatch{alarmStates: map[string]string{"hc-1": "OK"}, delay: 200 * time.Millisecond}
+  s3 := &fakeS3{}
+  defer func(previousPoller *Poller, previousState *StateStore, previousNotifier *Notifier) {
+    poller, state, notifier = previousPoller, previousState, previousNotifier
+  }(poller, state, notifier)
+  poller = newFakePoller(&fakeRoute53{}, cw)
+  state = poller.state
+  notifier = &Notifier{}
+  state.storeConfig(&LoadedConfig{
+    Service: &ServiceConfig{ServiceSpecs: []ServiceSpec{{
+      Name:             "api",
+      EnvironmentSpecs: []EnvironmentSpec{{Name: "prod", HostedZoneId: "Z1", DomainName: "api.example.com"}},
+    }}},
+    Sinks: []Sink{&S3Sink{Bucket: "status", Key: "main.json", client: s3}},
+  })
+  state.storeZones(&ZoneSnapshot{Zones: map[ZoneKey][]*route53.ResourceRecordSet{
+    {HostedZoneId: "Z1"}: {latencyRecord("api.example.com.", "us-east-1", "hc-1")},
+  }})
+
+  ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+  defer cancel()
+  runCycle(ctx, context.Background(), time.Second)
+
+  output, ok := s3.objects["status/main.json"]
+  if !ok {
+    t.Fatal("snapshot not published after the cycle timed out")
+  }
+  if !strings.Contains(string(output), "Health Check Timed Out") {
+    t.Errorf("published %s, want the timed out health check", output)
+  }
+}
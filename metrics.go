@@ -0,0 +1,147 @@
+package main
+
+import (
+  "fmt"
+  "io"
+  "net/http"
+  "sort"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+
+  "github.com/aws/aws-sdk-go/aws/request"
+  "github.com/aws/aws-sdk-go/aws/session"
+)
+
+type apiOperation struct {
+  API       string
+  Operation string
+}
+
+// Counters for every AWS request made by the fetch and post sessions
+type apiMetrics struct {
+  mu        sync.Mutex
+  calls     map[apiOperation]uint64
+  throttles map[apiOperation]uint64
+  errors    map[apiOperation]uint64
+}
+
+var awsMetrics = &apiMetrics{
+  calls:     make(map[apiOperation]uint64),
+  throttles: make(map[apiOperation]uint64),
+  errors:    make(map[apiOperation]uint64),
+}
+
+// Hooks the session's request handlers so each attempt, throttle and failed call is counted
+func instrumentSession(sess *session.Session) {
+  sess.Handlers.Send.PushFront(func(r *request.Request) {
+    awsMetrics.inc(awsMetrics.calls, r)
+  })
+  sess.Handlers.Retry.PushFront(func(r *request.Request) {
+    if request.IsErrorThrottle(r.Error) {
+      awsMetrics.inc(awsMetrics.throttles, r)
+    }
+  })
+  sess.Handlers.Complete.PushBack(func(r *request.Request) {
+    if r.Error != nil {
+      awsMetrics.inc(awsMetrics.errors, r)
+    }
+  })
+}
+
+func (m *apiMetrics) inc(counter map[apiOperation]uint64, r *request.Request) {
+  op := apiOperation{API: r.ClientInfo.ServiceName}
+  if r.Operation != nil {
+    op.Operation = r.Operation.Name
+  }
+  m.mu.Lock()
+  counter[op]++
+  m.mu.Unlock()
+}
+
+// Renders the health of the latest snapshot and the AWS API counters in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+  if snapshot := loadSnapshot(); snapshot != nil {
+    writeHealthMetrics(w, snapshot)
+  }
+  if poller != nil {
+    writeRefreshMetrics(w, poller)
+  }
+
+  awsMetrics.mu.Lock()
+  defer awsMetrics.mu.Unlock()
+  writeCounter(w, "route53_aws_api_calls_total", "AWS API requests made, including retries.", awsMetrics.calls)
+  writeCounter(w, "route53_aws_api_throttles_total", "AWS API requests rejected by throttling.", awsMetrics.throttles)
+  writeCounter(w, "route53_aws_api_errors_total", "AWS API calls that failed after retries.", awsMetrics.errors)
+}
+
+func writeHealthMetrics(w io.Writer, snapshot *Snapshot) {
+  serviceNames := make([]string, 0, len(snapshot.Services))
+  for name := range snapshot.Services {
+    serviceNames = append(serviceNames, name)
+  }
+  sort.Strings(serviceNames)
+
+  fmt.Fprintln(w, "# HELP route53_environment_health Environment health: 0 OK, 1 warning, 2 failing, 3 unknown.")
+  fmt.Fprintln(w, "# TYPE route53_environment_health gauge")
+  for _, name := range serviceNames {
+    for _, environment := range snapshot.Services[name].Environments {
+      fmt.Fprintf(w, "route53_environment_health{service=%s,environment=%s} %d\n",
+        quoteLabel(name), quoteLabel(environment.Name), environment.Health)
+    }
+  }
+
+  fmt.Fprintln(w, "# HELP route53_instance_health Instance health: 0 OK, 1 warning, 2 failing, 3 unknown.")
+  fmt.Fprintln(w, "# TYPE route53_instance_health gauge")
+  for _, name := range serviceNames {
+    for _, environment := range snapshot.Services[name].Environments {
+      // Instances sharing a name would produce duplicate series, so report the worst of them
+      instanceNames, instances := instancesByName(&environment)
+      for _, instanceName := range instanceNames {
+        fmt.Fprintf(w, "route53_instance_health{service=%s,environment=%s,instance=%s} %d\n",
+          quoteLabel(name), quoteLabel(environment.Name), quoteLabel(instanceName), instances[instanceName].Health)
+      }
+    }
+  }
+
+  fmt.Fprintln(w, "# HELP route53_snapshot_timestamp_seconds Time the latest status snapshot was produced.")
+  fmt.Fprintln(w, "# TYPE route53_snapshot_timestamp_seconds gauge")
+  fmt.Fprintf(w, "route53_snapshot_timestamp_seconds %d\n", snapshot.Modified.Unix())
+}
+
+func writeRefreshMetrics(w io.Writer, poller *Poller) {
+  fmt.Fprintln(w, "# HELP route53_refresh_throttled_streak Consecutive hosted zone refreshes that were throttled.")
+  fmt.Fprintln(w, "# TYPE route53_refresh_throttled_streak gauge")
+  fmt.Fprintf(w, "route53_refresh_throttled_streak %d\n", atomic.LoadInt64(&poller.throttledRefreshes))
+  fmt.Fprintln(w, "# HELP route53_refresh_interval_seconds Current interval between hosted zone refreshes, including backoff.")
+  fmt.Fprintln(w, "# TYPE route53_refresh_interval_seconds gauge")
+  fmt.Fprintf(w, "route53_refresh_interval_seconds %g\n", poller.refreshInterval(time.Duration(CONFIG.Route53IntervalSec)*time.Second).Seconds())
+}
+
+func writeCounter(w io.Writer, name string, help string, counter map[apiOperation]uint64) {
+  ops := make([]apiOperation, 0, len(counter))
+  for op := range counter {
+    ops = append(ops, op)
+  }
+  sort.Slice(ops, func(i, j int) bool {
+    if ops[i].API != ops[j].API {
+      return ops[i].API < ops[j].API
+    }
+    return ops[i].Operation < ops[j].Operation
+  })
+
+  fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+  fmt.Fprintf(w, "# TYPE %s counter\n", name)
+  for _, op := range ops {
+    fmt.Fprintf(w, "%s{api=%s,operation=%s} %d\n", name, quoteLabel(op.API), quoteLabel(op.Operation), counter[op])
+  }
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+  return `"` + labelEscaper.Replace(value) + `"`
+}
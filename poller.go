@@ -0,0 +1,433 @@
+package main
+
+import (
+  "context"
+  "math/rand"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+
+  log "github.com/Sirupsen/logrus"
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/awserr"
+  "github.com/aws/aws-sdk-go/aws/request"
+  "github.com/aws/aws-sdk-go/service/route53"
+)
+
+// Reads hosted zones from Route53 and evaluates the health of the configured services
+// AWS clients come from clientsFor so tests can inject fakes
+type Poller struct {
+  // Consecutive throttled refreshes, also read by the metrics handler; kept first for 64-bit alignment
+  throttledRefreshes int64
+  state       *StateStore
+  clientsFor  func(account *AccountSpec) (*AWSClients, error)
+  concurrency int
+  limiter     *rateLimiter
+  // Where the hosted zones are saved after each refresh, if anywhere
+  zoneCachePath string
+  // Closed once hosted zones are available, from the zone cache or the first refresh
+  ready     chan struct{}
+  readyOnce sync.Once
+}
+
+const (
+  route53Attempts = 4
+  // Persistent throttling stretches the refresh interval up to this many times its configured value
+  maxRefreshBackoff = 8
+)
+
+// Delay before the first retry of a throttled listing, doubled for each later retry
+var route53RetryBackoff = 500 * time.Millisecond
+
+// One evaluation of the services, reading a single zone snapshot throughout
+type pollCycle struct {
+  poller       *Poller
+  zones        *ZoneSnapshot
+  healthChecks *healthCheckCache
+}
+
+// Hosted zones and discovered services are published to state
+// Environments are evaluated concurrency at a time, with health check lookups limited to rateLimit a second
+func newPoller(state *StateStore, clientsFor func(account *AccountSpec) (*AWSClients, error), concurrency int, rateLimit float64) *Poller {
+  if concurrency < 1 {
+    concurrency = 1
+  }
+  return &Poller{state: state, clientsFor: clientsFor, concurrency: concurrency, limiter: newRateLimiter(rateLimit), ready: make(chan struct{})}
+}
+
+func (poller *Poller) newCycle() *pollCycle {
+  return &pollCycle{poller: poller, zones: poller.state.Zones(), healthChecks: newHealthCheckCache()}
+}
+
+func (poller *Poller) markReady() {
+  poller.readyOnce.Do(func() {
+    close(poller.ready)
+  })
+}
+
+// Starts from the zones saved by a previous run, which the first refresh replaces
+// Later refreshes are saved back to path
+func (poller *Poller) warmStart(path string) error {
+  poller.zoneCachePath = path
+  zones, fetched, err := readZoneCache(path)
+  if err != nil {
+    return err
+  }
+  if len(zones) == 0 {
+    return nil
+  }
+  oldest := time.Now()
+  for _, at := range fetched {
+    if at.Before(oldest) {
+      oldest = at
+    }
+  }
+  log.Info("Loaded ", len(zones), " hosted zones from ", path, ", oldest fetched ", time.Since(oldest).Truncate(time.Second), " ago")
+  poller.state.storeZones(&ZoneSnapshot{Zones: zones, Fetched: fetched})
+  poller.markReady()
+  return nil
+}
+
+// Re-reads every hosted zone the services use, running discovery first when configured
+// A zone that fails to load keeps its records from the previous refresh
+func (poller *Poller) refreshHostedZones(ctx context.Context, serviceConfig *ServiceConfig) {
+  previous := poller.state.Zones()
+  localHostedZones := make(map[ZoneKey][]*route53.ResourceRecordSet)
+  fetched := make(map[ZoneKey]time.Time)
+  failed := make(map[ZoneKey]bool)
+  throttled := false
+  if serviceConfig.Discovery != nil {
+    clients, err := poller.clientsFor(serviceConfig.Discovery.Account)
+    var discovered []ServiceSpec
+    if err == nil {
+      discovered, err = discoverServices(ctx, serviceConfig.Discovery, clients, localHostedZones)
+    }
+    if err != nil {
+      throttled = throttled || request.IsErrorThrottle(err)
+      log.Warning("Service discovery failed, keeping previously discovered services; ", err)
+    } else {
+      poller.state.storeDiscoveredServices(discovered)
+    }
+  } else {
+    poller.state.storeDiscoveredServices(nil)
+  }
+  for _, serviceSpec := range mergeServiceSpecs(serviceConfig.ServiceSpecs, poller.state.DiscoveredServices()) {
+    for _, envSpec := range serviceSpec.EnvironmentSpecs {
+      account := environmentAccount(&serviceSpec, &envSpec)
+      key := zoneKey(account, envSpec.HostedZoneId)
+      if _, ok := localHostedZones[key]; ok || failed[key] {
+        continue
+      }
+      clients, err := poller.clientsFor(account)
+      if err != nil {
+        log.Warning("Unable to create AWS clients for ", serviceSpec.Name, "/", envSpec.Name, "; ", err)
+        continue
+      }
+      records, err := fetchHostedZone(ctx, clients.Route53, envSpec.HostedZoneId)
+      if err == nil {
+        localHostedZones[key] = records
+        fetched[key] = time.Now()
+        continue
+      }
+      throttled = throttled || request.IsErrorThrottle(err)
+      failed[key] = true
+      if records, ok := previous.Zones[key]; ok {
+        log.Warning("Hosted zone ", envSpec.HostedZoneId, "; keeping the records fetched at ", previous.Fetched[key].Format(time.RFC3339))
+        localHostedZones[key] = records
+        fetched[key] = previous.Fetched[key]
+      }
+    }
+  }
+  // Zones read so far are kept, so a setup too large to read in one refresh still fills in over several
+  interrupted := ctx.Err() != nil
+  if interrupted {
+    log.Warning("Hosted zone refresh interrupted, keeping the previous records of zones not read; ", ctx.Err())
+    for key, records := range previous.Zones {
+      if _, ok := localHostedZones[key]; !ok {
+        localHostedZones[key] = records
+        if at, ok := previous.Fetched[key]; ok {
+          fetched[key] = at
+        }
+      }
+    }
+  }
+  // Zones read by discovery weren't timed individually
+  for key := range localHostedZones {
+    if _, ok := fetched[key]; !ok {
+      fetched[key] = time.Now()
+    }
+  }
+  poller.state.storeZones(&ZoneSnapshot{Zones: localHostedZones, Fetched: fetched})
+  // Throttling still lengthens the interval, but a refresh cut short doesn't prove it has stopped
+  if throttled || !interrupted {
+    poller.recordThrottling(throttled)
+  }
+  poller.markReady()
+
+  if poller.zoneCachePath != "" {
+    if err := writeZoneCache(poller.zoneCachePath, localHostedZones, fetched); err != nil {
+      log.Warning("Unable to save hosted zone cache to ", poller.zoneCachePath, "; ", err)
+    }
+  }
+}
+
+// Tracks runs of throttled refreshes, which stretch refreshInterval
+func (poller *Poller) recordThrottling(throttled bool) {
+  if !throttled {
+    if atomic.SwapInt64(&poller.throttledRefreshes, 0) > 0 {
+      log.Info("Route53 refreshes no longer throttled, returning to the configured refresh interval")
+    }
+    return
+  }
+  streak := atomic.AddInt64(&poller.throttledRefreshes, 1)
+  log.Warning("Route53 refresh throttled ", streak, " times in a row, backing off")
+}
+
+// Doubles the base interval for each consecutive throttled refresh, up to maxRefreshBackoff times the base
+func (poller *Poller) refreshInterval(base time.Duration) time.Duration {
+  interval := base
+  for streak := atomic.LoadInt64(&poller.throttledRefreshes); streak > 0 && interval < base*maxRefreshBackoff; streak-- {
+    interval *= 2
+  }
+  if interval > base*maxRefreshBackoff {
+    interval = base * maxRefreshBackoff
+  }
+  return interval
+}
+
+// Evaluates every service against the cached hosted zones, spreading the environments over the workers
+func (poller *Poller) poll(ctx context.Context, serviceConfig *ServiceConfig, serviceSpecs []ServiceSpec) map[string]Service {
+  cycle := poller.newCycle()
+
+  type job struct {
+    environmentSpec *EnvironmentSpec
+    environment     *Environment
+    zone            ZoneKey
+    source          HealthSource
+  }
+  // Each job writes only its own environment, so results need no locking
+  results := make([]Service, len(serviceSpecs))
+  var jobs []job
+  batchSources := make(map[BatchHealthSource]bool)
+  for i := range serviceSpecs {
+    serviceSpec := &serviceSpecs[i]
+    results[i] = Service{Name: serviceSpec.Name, DisplayName: serviceSpec.DisplayName, Environments: make([]Environment, len(serviceSpec.EnvironmentSpecs))}
+    for j := range serviceSpec.EnvironmentSpecs {
+      environmentSpec := &serviceSpec.EnvironmentSpecs[j]
+      environment := &results[i].Environments[j]
+      *environment = Environment{Name: environmentSpec.Name, Health: 3, Reason: "No Health Status Found"}
+
+      account := environmentAccount(serviceSpec, environmentSpec)
+      clients, err := poller.clientsFor(account)
+      if err != nil {
+        log.Error("Unable to create AWS clients for ", serviceSpec.Name, "/", environmentSpec.Name, "; ", err)
+        continue
+      }
+      source, err := healthSourceFor(serviceConfig, serviceSpec, clients)
+      if err != nil {
+        log.Error(err)
+        continue
+      }
+      if batchSource, ok := source.(BatchHealthSource); ok {
+        batchSources[batchSource] = true
+      }
+      jobs = append(jobs, job{environmentSpec: environmentSpec, environment: environment, zone: zoneKey(account, environmentSpec.HostedZoneId), source: source})
+    }
+  }
+  for batchSource := range batchSources {
+    batchSource.reset()
+  }
+
+  workers := poller.concurrency
+  if workers > len(jobs) {
+    workers = len(jobs)
+  }
+  queue := make(chan job)
+  var wg sync.WaitGroup
+  for i := 0; i < workers; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for job := range queue {
+        cycle.getEnvironment(ctx, job.environmentSpec, job.environment, job.zone, job.source)
+      }
+    }()
+  }
+  for _, job := range jobs {
+    queue <- job
+  }
+  close(queue)
+  wg.Wait()
+
+  services := make(map[string]Service)
+  for _, service := range results {
+    services[service.Name] = service
+  }
+  return services
+}
+
+func (cycle *pollCycle) getEnvironment(ctx context.Context, environmentSpec *EnvironmentSpec, environment *Environment, zone ZoneKey, source HealthSource) {
+
+  records := cycle.zones.Zones[zone]
+  recordTypes := environmentSpec.RecordTypes
+  if len(recordTypes) == 0 {
+    recordTypes = []string{"A"}
+  }
+  for _, recordSet := range records {
+    if aws.StringValue(recordSet.Name) == environmentSpec.DomainName+"." && containsString(recordTypes, aws.StringValue(recordSet.Type)) {
+      cycle.setInstance(ctx, environment, zone, recordSet, source)
+    }
+  }
+  aggregateEnvironment(&environmentSpec.Aggregation, environment)
+  environment.AsOfTime = int32(time.Now().Unix())
+}
+
+// Fetches all recordsets from hosted zone
+// Caches due to AWS limits on Route53 API requests
+// Follows NextRecordName until the listing is no longer truncated, retrying a throttled page with
+// exponential backoff and jitter and carrying on from that page, so pages already read aren't fetched again
+// Returns pointer to all recordsets
+func fetchHostedZone(ctx context.Context, r53 Route53API, hostedZoneId string) ([]*route53.ResourceRecordSet, error) {
+  log.Debug("Hosted zone ", hostedZoneId, "; Making call to Route53")
+  input := &route53.ListResourceRecordSetsInput{HostedZoneId: aws.String(hostedZoneId)}
+  var records []*route53.ResourceRecordSet
+  pages := 0
+  backoff := route53RetryBackoff
+  for attempt := 1; ; attempt++ {
+    page, err := r53.ListResourceRecordSetsWithContext(ctx, input, withoutThrottleRetries)
+    if err == nil {
+      records = append(records, page.ResourceRecordSets...)
+      pages++
+      if !aws.BoolValue(page.IsTruncated) {
+        log.Debug("Hosted zone ", hostedZoneId, "; Read ", len(records), " records in ", pages, " pages")
+        return records, nil
+      }
+      input.StartRecordName = page.NextRecordName
+      input.StartRecordType = page.NextRecordType
+      input.StartRecordIdentifier = page.NextRecordIdentifier
+      // Each page gets its own attempts
+      attempt, backoff = 0, route53RetryBackoff
+      continue
+    }
+    if !request.IsErrorThrottle(err) {
+      log.Warning("Error calling ListResourceRecordSets", err)
+      return nil, err
+    }
+    if attempt == route53Attempts {
+      log.Warning("ListResourceRecordSets rate throttled for hosted zone ", hostedZoneId, ", giving up after ", attempt, " attempts at page ", pages+1)
+      return nil, err
+    }
+
+    // Half fixed, half random so pollers throttled together don't retry together
+    delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+    log.Warning("ListResourceRecordSets rate throttled for hosted zone ", hostedZoneId, " at page ", pages+1, ", attempt ", attempt, ", retrying in ", delay)
+    select {
+    case <-time.After(delay):
+    case <-ctx.Done():
+      return nil, err
+    }
+    backoff *= 2
+  }
+}
+
+// Leaves retrying throttled pages to fetchHostedZone, so the SDK's own throttle retries don't multiply
+// its attempts; server and connection errors are still retried by the SDK
+type throttleRetryer struct {
+  request.Retryer
+}
+
+func (retryer throttleRetryer) ShouldRetry(r *request.Request) bool {
+  if request.IsErrorThrottle(r.Error) {
+    return false
+  }
+  return retryer.Retryer.ShouldRetry(r)
+}
+
+var withoutThrottleRetries request.Option = func(r *request.Request) {
+  r.Retryer = throttleRetryer{r.Retryer}
+}
+
+func (cycle *pollCycle) setInstance(ctx context.Context, environment *Environment, zone ZoneKey, recordSet *route53.ResourceRecordSet, source HealthSource) {
+
+  instance := newInstance(recordSet)
+  healthCheck := cycle.getRecordSetHealth(ctx, zone, recordSet, source, 0)
+  instance.Health = healthCheck.Health
+  instance.Reason = healthCheck.Reason
+
+  environment.Instances = append(environment.Instances, instance)
+}
+
+// Alias chains inside a zone are followed at most this deep
+const maxAliasDepth = 5
+
+// Works out the health of a single record set from its health check or, for alias records
+// that evaluate target health, from the records it points at in the same zone
+// Aliases to AWS resources such as ELBs and CloudFront are left as records without a health check,
+// since reading their health needs those services' own APIs
+func (cycle *pollCycle) getRecordSetHealth(ctx context.Context, zone ZoneKey, recordSet *route53.ResourceRecordSet, source HealthSource, depth int) HealthCheck {
+
+  healthCheckId := aws.StringValue(recordSet.HealthCheckId)
+  if healthCheckId != "" {
+    return cycle.getHealthCheck(ctx, healthCheckId, source)
+  }
+
+  aliasTarget := recordSet.AliasTarget
+  if aliasTarget != nil && aws.BoolValue(aliasTarget.EvaluateTargetHealth) &&
+    trimHostedZoneId(aws.StringValue(aliasTarget.HostedZoneId)) == trimHostedZoneId(zone.HostedZoneId) {
+    if depth >= maxAliasDepth {
+      log.Warn("Alias chain too deep for record set ", aws.StringValue(recordSet.Name))
+      return HealthCheck{Health: 1, Reason: "Alias Chain Too Deep"}
+    }
+
+    // An alias to records in the same zone is healthy when any of its targets is healthy
+    targetHealth := HealthCheck{Health: 3, Reason: "Alias Target Not Found"}
+    targetName := aws.StringValue(aliasTarget.DNSName)
+    for _, target := range cycle.zones.Zones[zone] {
+      if strings.EqualFold(aws.StringValue(target.Name), targetName) && aws.StringValue(target.Type) == aws.StringValue(recordSet.Type) {
+        health := cycle.getRecordSetHealth(ctx, zone, target, source, depth+1)
+        if health.Health < targetHealth.Health {
+          targetHealth = health
+        }
+      }
+    }
+    return targetHealth
+  }
+
+  log.Warn("No Healthcheck found for record set ", aws.StringValue(recordSet.Name), " ", aws.StringValue(recordSet.SetIdentifier))
+  return HealthCheck{Health: 1, Reason: "No Healthcheck Found"}
+}
+
+// Looks up the health of a Route53 health check, once per health check and source per run
+func (cycle *pollCycle) getHealthCheck(ctx context.Context, healthCheckId string, source HealthSource) HealthCheck {
+  return cycle.healthChecks.get(source, healthCheckId, func() HealthCheck {
+    // Batch sources make their calls once per cycle, not per health check
+    err := ctx.Err()
+    if _, batched := source.(BatchHealthSource); !batched {
+      err = cycle.poller.limiter.wait(ctx)
+    }
+    var healthCheck HealthCheck
+    if err == nil {
+      healthCheck, err = source.GetHealthCheck(ctx, healthCheckId)
+    }
+    if err != nil && ctx.Err() != nil {
+      // The cycle ran out of time; the next cycle looks again
+      log.Warning("Gave up on healthCheckId ", healthCheckId, "; ", ctx.Err())
+      return HealthCheck{Health: 3, Reason: "Health Check Timed Out"}
+    }
+    if err != nil {
+      // One failed lookup shouldn't take down the whole status page, so report the instance as unknown
+      log.Error("Error fetching status of healthCheckId ", healthCheckId, "; ", err)
+      return HealthCheck{Health: 3, Reason: checkErrorReason(err)}
+    }
+    return healthCheck
+  })
+}
+
+// Summarises an API error for the status page without the request details
+func checkErrorReason(err error) string {
+  if aerr, ok := err.(awserr.Error); ok {
+    return "Check Error: " + aerr.Code() + ": " + aerr.Message()
+  }
+  return "Check Error: " + err.Error()
+}
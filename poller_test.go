@@ -0,0 +1,567 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "net/http"
+  "reflect"
+  "testing"
+  "time"
+
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/awserr"
+  "github.com/aws/aws-sdk-go/aws/request"
+  "github.com/aws/aws-sdk-go/service/route53"
+)
+
+func latencyRecord(name string, region string, healthCheckId string) *route53.ResourceRecordSet {
+  record := recordSet(name, "A", healthCheckId)
+  record.Region = aws.String(region)
+  record.SetIdentifier = aws.String(region)
+  return record
+}
+
+func TestGetEnvironmentMatching(t *testing.T) {
+  zone := ZoneKey{HostedZoneId: "Z1"}
+  records := []*route53.ResourceRecordSet{
+    latencyRecord("api.example.com.", "us-east-1", "hc-1"),
+    latencyRecord("api.example.com.", "eu-west-1", "hc-2"),
+    recordSet("api.example.com.", "AAAA", "hc-3"),
+    recordSet("api.example.com.", "TXT", ""),
+    recordSet("web.example.com.", "A", "hc-4"),
+    latencyRecord("api.example.com.example.com.", "us-west-2", "hc-5"),
+  }
+
+  tests := []struct {
+    name        string
+    domainName  string
+    recordTypes []string
+    instances   []string
+  }{
+    {"defaults to A records", "api.example.com", nil, []string{"us-east-1", "eu-west-1"}},
+    {"listed record types", "api.example.com", []string{"A", "AAAA"}, []string{"us-east-1", "eu-west-1", "api.example.com"}},
+    {"other domain", "web.example.com", nil, []string{"web.example.com"}},
+    {"no matching records", "missing.example.com", nil, nil},
+    {"no matching types", "api.example.com", []string{"CNAME"}, nil},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      poller := newFakePoller(&fakeRoute53{}, &fakeCloudWatch{alarmStates: map[string]string{"hc-1": "OK", "hc-2": "OK", "hc-3": "OK", "hc-4": "OK"}})
+      poller.state.storeZones(&ZoneSnapshot{Zones: map[ZoneKey][]*route53.ResourceRecordSet{zone: records}})
+      clients, _ := poller.clientsFor(nil)
+
+      spec := EnvironmentSpec{Name: "prod", HostedZoneId: "Z1", DomainName: test.domainName, RecordTypes: test.recordTypes}
+      environment := Environment{Name: "prod", Health: 3, Reason: "No Health Status Found"}
+      poller.newCycle().getEnvironment(context.Background(), &spec, &environment, zone, clients.HealthSources["cloudwatch"])
+
+      var names []string
+      for _, instance := range environment.Instances {
+        names = append(names, instance.Name)
+      }
+      if !reflect.DeepEqual(names, test.instances) {
+        t.Errorf("instances = %v, want %v", names, test.instances)
+      }
+      if len(test.instances) == 0 && environment.Health != 3 {
+        t.Errorf("health = %d, want 3 for an environment without instances", environment.Health)
+      }
+    })
+  }
+}
+
+func TestGetRecordSetHealth(t *testing.T) {
+  zone := ZoneKey{HostedZoneId: "Z1"}
+  alias := func(name string, targetZone string, target string) *route53.ResourceRecordSet {
+    record := recordSet(name, "A", "")
+    record.AliasTarget = &route53.AliasTarget{HostedZoneId: aws.String(targetZone), DNSName: aws.String(target), EvaluateTargetHealth: aws.Bool(true)}
+    return record
+  }
+  records := []*route53.ResourceRecordSet{
+    latencyRecord("origin.example.com.", "us-east-1", "hc-ok"),
+    latencyRecord("origin.example.com.", "eu-west-1", "hc-alarm"),
+    recordSet("down.example.com.", "A", "hc-alarm"),
+    alias("loop.example.com.", "Z1", "loop.example.com."),
+  }
+
+  tests := []struct {
+    name      string
+    recordSet *route53.ResourceRecordSet
+    want      HealthCheck
+  }{
+    {"alarm ok", recordSet("a.example.com.", "A", "hc-ok"), HealthCheck{0, ""}},
+    {"alarm firing", recordSet("a.example.com.", "A", "hc-alarm"), HealthCheck{2, "Healthcheck Failing"}},
+    {"no alarm", recordSet("a.example.com.", "A", "hc-none"), HealthCheck{1, "No Alarm Found"}},
+    {"no health check", recordSet("a.example.com.", "A", ""), HealthCheck{1, "No Healthcheck Found"}},
+    {"alias to another zone", alias("a.example.com.", "/hostedzone/ZELB", "elb.amazonaws.com."), HealthCheck{1, "No Healthcheck Found"}},
+    {"alias takes best target", alias("a.example.com.", "/hostedzone/Z1", "origin.example.com."), HealthCheck{0, ""}},
+    {"alias to failing target", alias("a.example.com.", "Z1", "down.example.com."), HealthCheck{2, "Healthcheck Failing"}},
+    {"alias target missing", alias("a.example.com.", "Z1", "missing.example.com."), HealthCheck{3, "Alias Target Not Found"}},
+    {"alias loop", records[3], HealthCheck{1, "Alias Chain Too Deep"}},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      poller := newFakePoller(&fakeRoute53{}, &fakeCloudWatch{alarmStates: map[string]string{"hc-ok": "OK", "hc-alarm": "ALARM"}})
+      poller.state.storeZones(&ZoneSnapshot{Zones: map[ZoneKey][]*route53.ResourceRecordSet{zone: records}})
+      clients, _ := poller.clientsFor(nil)
+
+      got := poller.newCycle().getRecordSetHealth(context.Background(), zone, test.recordSet, clients.HealthSources["cloudwatch"], 0)
+      if got != test.want {
+        t.Errorf("health = %+v, want %+v", got, test.want)
+      }
+    })
+  }
+}
+
+func TestRoute53HealthSource(t *testing.T) {
+  observation := func(status string) *route53.HealthCheckObservation {
+    return &route53.HealthCheckObservation{StatusReport: &route53.StatusReport{Status: aws.String(status)}}
+  }
+  success, failure := observation("Success: HTTP Status Code 200"), observation("Failure: Connection timed out")
+
+  tests := []struct {
+    name         string
+    observations []*route53.HealthCheckObservation
+    want         HealthCheck
+  }{
+    {"all healthy", []*route53.HealthCheckObservation{success, success}, HealthCheck{0, ""}},
+    {"over threshold", []*route53.HealthCheckObservation{success, failure, failure, failure}, HealthCheck{0, ""}},
+    {"under threshold", []*route53.HealthCheckObservation{success, failure, failure, failure, failure, failure}, HealthCheck{2, "Healthcheck Failing (1 of 6 checkers healthy)"}},
+    {"no observations", nil, HealthCheck{1, "No Checker Observations"}},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      source := &Route53HealthSource{client: &fakeRoute53{observations: map[string][]*route53.HealthCheckObservation{"hc": test.observations}}}
+      got, err := source.GetHealthCheck(context.Background(), "hc")
+      if err != nil {
+        t.Fatal(err)
+      }
+      if got != test.want {
+        t.Errorf("health = %+v, want %+v", got, test.want)
+      }
+    })
+  }
+}
+
+func TestFetchHostedZone(t *testing.T) {
+  defer func(backoff time.Duration) { route53RetryBackoff = backoff }(route53RetryBackoff)
+  route53RetryBackoff = time.Millisecond
+
+  r53 := &fakeRoute53{
+    zones: map[string][]*route53.ResourceRecordSet{"Z1": {
+      recordSet("a.example.com.", "A", ""),
+      recordSet("b.example.com.", "A", ""),
+      recordSet("c.example.com.", "A", ""),
+    }},
+    zoneErrors: map[string]error{"ZTHROTTLED": awserr.New("Throttling", "Rate exceeded", nil)},
+  }
+
+  records, err := fetchHostedZone(context.Background(), r53, "Z1")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(records) != 3 {
+    t.Errorf("read %d records across pages, want 3", len(records))
+  }
+
+  records, err = fetchHostedZone(context.Background(), r53, "ZTHROTTLED")
+  if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "Throttling" {
+    t.Errorf("err = %v, want the throttling error", err)
+  }
+  if records != nil {
+    t.Errorf("records = %v, want none for a throttled zone", records)
+  }
+
+  // The SDK leaves throttles to fetchHostedZone but still retries server errors
+  throttle := &request.Request{Error: awserr.New("Throttling", "Rate exceeded", nil), HTTPResponse: &http.Response{StatusCode: 400}}
+  unavailable := &request.Request{Error: awserr.New("ServiceUnavailable", "Service unavailable", nil), HTTPResponse: &http.Response{StatusCode: 503}}
+  if r53.retryer.ShouldRetry(throttle) || !r53.retryer.ShouldRetry(unavailable) || r53.retryer.MaxRetries() != 3 {
+    t.Error("SDK retries throttled pages, or no longer retries server errors")
+  }
+}
+
+func TestFetchHostedZoneThrottledPartWay(t *testing.T) {
+  defer func(backoff time.Duration) { route53RetryBackoff = backoff }(route53RetryBackoff)
+  route53RetryBackoff = time.Millisecond
+
+  var records []*route53.ResourceRecordSet
+  for i := 0; i < 20; i++ {
+    records = append(records, latencyRecord("api.example.com.", fmt.Sprintf("region-%02d", i), ""))
+  }
+  // Ten pages, with every fourth page request throttled
+  r53 := &fakeRoute53{zones: map[string][]*route53.ResourceRecordSet{"Z1": records}, throttleEvery: 4}
+
+  got, err := fetchHostedZone(context.Background(), r53, "Z1")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !reflect.DeepEqual(got, records) {
+    t.Errorf("read %d records, want all %d in order", len(got), len(records))
+  }
+  if r53.recordCalls != 13 {
+    t.Errorf("made %d page requests, want 13: ten pages and three retried throttles", r53.recordCalls)
+  }
+}
+
+func TestRefreshHostedZonesFailures(t *testing.T) {
+  defer func(backoff time.Duration) { route53RetryBackoff = backoff }(route53RetryBackoff)
+  route53RetryBackoff = time.Millisecond
+
+  serviceConfig := &ServiceConfig{ServiceSpecs: []ServiceSpec{
+    {Name: "a", EnvironmentSpecs: []EnvironmentSpec{{Name: "prod", HostedZoneId: "Z1"}, {Name: "stage", HostedZoneId: "Z1"}}},
+    {Name: "b", EnvironmentSpecs: []EnvironmentSpec{{Name: "prod", HostedZoneId: "Z2"}}},
+  }}
+  previous := []*route53.ResourceRecordSet{recordSet("old.example.com.", "A", "hc-old")}
+
+  tests := []struct {
+    name           string
+    zoneErrors     map[string]error
+    throttledCalls map[string]int
+    previous       bool
+    wantCalls      int
+    wantZ2         int
+    wantThrottled  int64
+  }{
+    {"throttled zone left out", nil, map[string]int{"Z2": 10}, false, 1 + route53Attempts, -1, 1},
+    {"throttled zone keeps previous records", nil, map[string]int{"Z2": 10}, true, 1 + route53Attempts, 1, 1},
+    {"retry recovers", nil, map[string]int{"Z2": 2}, false, 1 + 3, 2, 0},
+    {"other errors not retried", map[string]error{"Z2": awserr.New("NoSuchHostedZone", "No hosted zone found", nil)}, nil, true, 2, 1, 0},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      r53 := &fakeRoute53{
+        zones: map[string][]*route53.ResourceRecordSet{
+          "Z1": {recordSet("a.example.com.", "A", "hc-1")},
+          "Z2": {recordSet("b.example.com.", "A", "hc-2"), recordSet("c.example.com.", "A", "hc-3")},
+        },
+        zoneErrors:     test.zoneErrors,
+        throttledCalls: test.throttledCalls,
+      }
+      poller := newFakePoller(r53, &fakeCloudWatch{})
+      if test.previous {
+        poller.state.storeZones(&ZoneSnapshot{Zones: map[ZoneKey][]*route53.ResourceRecordSet{{HostedZoneId: "Z2"}: previous}})
+      }
+
+      poller.refreshHostedZones(context.Background(), serviceConfig)
+
+      if r53.recordCalls != test.wantCalls {
+        t.Errorf("ListResourceRecordSets called %d times, want %d", r53.recordCalls, test.wantCalls)
+      }
+      if len(poller.state.Zones().Zones[ZoneKey{HostedZoneId: "Z1"}]) != 1 {
+        t.Error("Z1 missing from the hosted zone cache")
+      }
+      records, ok := poller.state.Zones().Zones[ZoneKey{HostedZoneId: "Z2"}]
+      if test.wantZ2 < 0 && ok {
+        t.Errorf("Z2 cached with %d records, want it left out", len(records))
+      } else if test.wantZ2 >= 0 && len(records) != test.wantZ2 {
+        t.Errorf("Z2 has %d records, want %d", len(records), test.wantZ2)
+      }
+      if poller.throttledRefreshes != test.wantThrottled {
+        t.Errorf("throttled refreshes = %d, want %d", poller.throttledRefreshes, test.wantThrottled)
+      }
+    })
+  }
+}
+
+func TestInterruptedRefresh(t *testing.T) {
+  defer func(backoff time.Duration) { route53RetryBackoff = backoff }(route53RetryBackoff)
+  route53RetryBackoff = time.Hour
+
+  r53 := &fakeRoute53{
+    zones: map[string][]*route53.ResourceRecordSet{
+      "Z1": {recordSet("a.example.com.", "A", "hc-1")},
+      "Z2": {recordSet("b.example.com.", "A", "hc-2")},
+      "Z3": {recordSet("c.example.com.", "A", "hc-3"), recordSet("d.example.com.", "A", "hc-4")},
+    },
+    throttledCalls: map[string]int{"Z2": 10},
+  }
+  poller := newFakePoller(r53, &fakeCloudWatch{})
+  fetchedAt := time.Now().Add(-time.Hour)
+  poller.state.storeZones(&ZoneSnapshot{
+    Zones:   map[ZoneKey][]*route53.ResourceRecordSet{{HostedZoneId: "Z3"}: {recordSet("old.example.com.", "A", "hc-old")}},
+    Fetched: map[ZoneKey]time.Time{{HostedZoneId: "Z3"}: fetchedAt},
+  })
+  serviceConfig := &ServiceConfig{ServiceSpecs: []ServiceSpec{{Name: "a", EnvironmentSpecs: []EnvironmentSpec{
+    {Name: "one", HostedZoneId: "Z1"},
+    {Name: "two", HostedZoneId: "Z2"},
+    {Name: "three", HostedZoneId: "Z3"},
+  }}}}
+
+  // The refresh reads Z1, then times out waiting to retry the throttled Z2 listing before reaching Z3
+  ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+  defer cancel()
+  poller.refreshHostedZones(ctx, serviceConfig)
+
+  zones := poller.state.Zones()
+  if len(zones.Zones[ZoneKey{HostedZoneId: "Z1"}]) != 1 {
+    t.Errorf("Z1 = %v, want the records read before the timeout", zones.Zones[ZoneKey{HostedZoneId: "Z1"}])
+  }
+  if _, ok := zones.Zones[ZoneKey{HostedZoneId: "Z2"}]; ok {
+    t.Error("Z2 cached although it was never read")
+  }
+  if records := zones.Zones[ZoneKey{HostedZoneId: "Z3"}]; len(records) != 1 || !zones.Fetched[ZoneKey{HostedZoneId: "Z3"}].Equal(fetchedAt) {
+    t.Errorf("Z3 = %v fetched %v, want the previous records", records, zones.Fetched[ZoneKey{HostedZoneId: "Z3"}])
+  }
+  if poller.throttledRefreshes != 1 {
+    t.Errorf("throttled refreshes = %d, want 1 after a throttled refresh timed out", poller.throttledRefreshes)
+  }
+}
+
+func TestRefreshInterval(t *testing.T) {
+  tests := []struct {
+    throttledRefreshes int64
+    want               time.Duration
+  }{
+    {0, 30 * time.Second},
+    {1, 60 * time.Second},
+    {2, 120 * time.Second},
+    {3, 240 * time.Second},
+    {10, 240 * time.Second},
+  }
+
+  for _, test := range tests {
+    poller := &Poller{throttledRefreshes: test.throttledRefreshes}
+    if got := poller.refreshInterval(30 * time.Second); got != test.want {
+      t.Errorf("%d throttled refreshes: interval = %v, want %v", test.throttledRefreshes, got, test.want)
+    }
+  }
+
+  // A refresh that isn't throttled resets the backoff
+  poller := &Poller{throttledRefreshes: 3}
+  poller.recordThrottling(false)
+  if got := poller.refreshInterval(30 * time.Second); got != 30*time.Second {
+    t.Errorf("interval after recovering = %v, want 30s", got)
+  }
+}
+
+func TestPoll(t *testing.T) {
+  r53 := &fakeRoute53{zones: map[string][]*route53.ResourceRecordSet{"Z1": {
+    latencyRecord("api.example.com.", "us-east-1", "hc-1"),
+    latencyRecord("api.example.com.", "eu-west-1", "hc-2"),
+  }}}
+  cw := &fakeCloudWatch{alarmStates: map[string]string{"hc-1": "OK", "hc-2": "ALARM"}}
+  poller := newFakePoller(r53, cw)
+  serviceConfig := &ServiceConfig{ServiceSpecs: []ServiceSpec{{
+    Name:        "api",
+    DisplayName: "API",
+    EnvironmentSpecs: []EnvironmentSpec{
+      {Name: "best", HostedZoneId: "Z1", DomainName: "api.example.com"},
+      {Name: "worst", HostedZoneId: "Z1", DomainName: "api.example.com", Aggregation: AggregationSpec{Policy: "worst"}},
+      {Name: "missing", HostedZoneId: "Z1", DomainName: "missing.example.com"},
+    },
+  }}}
+
+  poller.refreshHostedZones(context.Background(), serviceConfig)
+  services := poller.poll(context.Background(), serviceConfig, serviceConfig.ServiceSpecs)
+
+  service := services["api"]
+  if service.DisplayName != "API" || len(service.Environments) != 3 {
+    t.Fatalf("service = %+v", service)
+  }
+  want := []HealthCheck{{0, ""}, {2, "Healthcheck Failing"}, {3, "No Health Status Found"}}
+  for i, environment := range service.Environments {
+    if got := (HealthCheck{environment.Health, environment.Reason}); got != want[i] {
+      t.Errorf("%s health = %+v, want %+v", environment.Name, got, want[i])
+    }
+  }
+  // Each health check is looked up once per cycle, however many environments share it
+  if cw.calls != 2 {
+    t.Errorf("DescribeAlarmsForMetric called %d times, want 2", cw.calls)
+  }
+}
+
+func TestCancelledCycle(t *testing.T) {
+  r53 := &fakeRoute53{zones: map[string][]*route53.ResourceRecordSet{"Z1": {recordSet("api.example.com.", "A", "hc-1")}}}
+  cw := &fakeCloudWatch{alarmStates: map[string]string{"hc-1": "OK"}}
+  poller := newFakePoller(r53, cw)
+  serviceConfig := &ServiceConfig{ServiceSpecs: []ServiceSpec{{
+    Name:             "api",
+    EnvironmentSpecs: []EnvironmentSpec{{Name: "prod", HostedZoneId: "Z1", DomainName: "api.example.com"}},
+  }}}
+  poller.refreshHostedZones(context.Background(), serviceConfig)
+
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+
+  // An interrupted refresh keeps the zones from the last complete one
+  poller.refreshHostedZones(ctx, serviceConfig)
+  if len(poller.state.Zones().Zones[ZoneKey{HostedZoneId: "Z1"}]) != 1 {
+    t.Fatalf("hosted zones = %v, want the previous refresh", poller.state.Zones().Zones)
+  }
+
+  instance := poller.poll(ctx, serviceConfig, serviceConfig.ServiceSpecs)["api"].Environments[0].Instances[0]
+  if instance.Health != 3 || instance.Reason != "Health Check Timed Out" {
+    t.Errorf("health = %d %q, want the timed out status", instance.Health, instance.Reason)
+  }
+}
+
+func TestHealthCheckErrors(t *testing.T) {
+  tests := []struct {
+    name string
+    err  error
+    want string
+  }{
+    {"aws error", awserr.New("Throttling", "Rate exceeded", nil), "Check Error: Throttling: Rate exceeded"},
+    {"other error", errors.New("connection reset"), "Check Error: connection reset"},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      r53 := &fakeRoute53{zones: map[string][]*route53.ResourceRecordSet{"Z1": {
+        latencyRecord("api.example.com.", "us-east-1", "hc-1"),
+        latencyRecord("api.example.com.", "eu-west-1", "hc-1"),
+      }}}
+      cw := &fakeCloudWatch{err: test.err}
+      poller := newFakePoller(r53, cw)
+      serviceConfig := &ServiceConfig{ServiceSpecs: []ServiceSpec{{
+        Name:             "api",
+        EnvironmentSpecs: []EnvironmentSpec{{Name: "prod", HostedZoneId: "Z1", DomainName: "api.example.com", Aggregation: AggregationSpec{Policy: "worst"}}},
+      }}}
+      poller.refreshHostedZones(context.Background(), serviceConfig)
+
+      environment := poller.poll(context.Background(), serviceConfig, serviceConfig.ServiceSpecs)["api"].Environments[0]
+      for _, instance := range environment.Instances {
+        if instance.Health != 3 || instance.Reason != test.want {
+          t.Errorf("%s health = %d %q, want 3 %q", instance.Name, instance.Health, instance.Reason, test.want)
+        }
+      }
+      if environment.Health != 3 || environment.Reason != test.want {
+        t.Errorf("environment health = %d %q, want 3 %q", environment.Health, environment.Reason, test.want)
+      }
+      // A failed lookup is not repeated within the cycle
+      if cw.calls != 1 {
+        t.Errorf("DescribeAlarmsForMetric called %d times, want 1", cw.calls)
+      }
+    })
+  }
+}
+
+func TestPollConcurrency(t *testing.T) {
+  var records []*route53.ResourceRecordSet
+  var environmentSpecs []EnvironmentSpec
+  alarmStates := make(map[string]string)
+  for i := 0; i < 20; i++ {
+    domainName := fmt.Sprintf("env%d.example.com", i)
+    healthCheckId := fmt.Sprintf("hc-%d", i)
+    records = append(records, recordSet(domainName+".", "A", healthCheckId))
+    environmentSpecs = append(environmentSpecs, EnvironmentSpec{Name: fmt.Sprintf("env%d", i), HostedZoneId: "Z1", DomainName: domainName})
+    alarmStates[healthCheckId] = "OK"
+  }
+  alarmStates["hc-3"] = "ALARM"
+
+  tests := []struct {
+    name        string
+    concurrency int
+  }{
+    {"sequential", 1},
+    {"bounded", 4},
+    {"more workers than environments", 50},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      cw := &fakeCloudWatch{alarmStates: alarmStates, delay: time.Millisecond}
+      clients := clientsWith(&fakeRoute53{zones: map[string][]*route53.ResourceRecordSet{"Z1": records}}, cw)
+      poller := newPoller(&StateStore{}, func(account *AccountSpec) (*AWSClients, error) { return clients, nil }, test.concurrency, 0)
+      // Two services share every health check
+      serviceConfig := &ServiceConfig{ServiceSpecs: []ServiceSpec{
+        {Name: "a", EnvironmentSpecs: environmentSpecs},
+        {Name: "b", EnvironmentSpecs: environmentSpecs},
+      }}
+      poller.refreshHostedZones(context.Background(), serviceConfig)
+
+      services := poller.poll(context.Background(), serviceConfig, serviceConfig.ServiceSpecs)
+
+      for _, name := range []string{"a", "b"} {
+        environments := services[name].Environments
+        if len(environments) != 20 {
+          t.Fatalf("%s has %d environments, want 20", name, len(environments))
+        }
+        for i, environment := range environments {
+          wantHealth := 0
+          if i == 3 {
+            wantHealth = 2
+          }
+          if environment.Name != environmentSpecs[i].Name || environment.Health != wantHealth {
+            t.Errorf("%s environment %d = %s health %d, want %s health %d", name, i, environment.Name, environment.Health, environmentSpecs[i].Name, wantHealth)
+          }
+        }
+      }
+      if cw.calls != 20 {
+        t.Errorf("DescribeAlarmsForMetric called %d times, want once per health check", cw.calls)
+      }
+      if cw.maxInFlight > test.concurrency {
+        t.Errorf("%d lookups in flight, want at most %d", cw.maxInFlight, test.concurrency)
+      }
+    })
+  }
+}
+
+func TestRateLimiter(t *testing.T) {
+  limiter := newRateLimiter(200)
+  start := time.Now()
+  for i := 0; i < 5; i++ {
+    if err := limiter.wait(context.Background()); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+    t.Errorf("5 calls at 200/s took %v, want at least 20ms", elapsed)
+  }
+
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  if err := newRateLimiter(0.001).wait(ctx); err == nil {
+    t.Error("wait returned without error after ctx ended")
+  }
+  if err := newRateLimiter(0).wait(context.Background()); err != nil {
+    t.Errorf("unlimited wait = %v", err)
+  }
+}
+
+func TestBatchCloudWatchHealthSource(t *testing.T) {
+  var records []*route53.ResourceRecordSet
+  var environmentSpecs []EnvironmentSpec
+  for _, id := range []string{"hc-ok", "hc-alarm", "hc-data", "hc-none", "hc-ec2"} {
+    records = append(records, recordSet(id+".example.com.", "A", id))
+    environmentSpecs = append(environmentSpecs, EnvironmentSpec{Name: id, HostedZoneId: "Z1", DomainName: id + ".example.com"})
+  }
+  want := map[string]HealthCheck{
+    "hc-ok":    {0, ""},
+    "hc-alarm": {2, "Healthcheck Failing"},
+    "hc-data":  {2, "Healthcheck Failing"},
+    "hc-none":  {1, "No Alarm Found"},
+    "hc-ec2":   {1, "No Alarm Found"},
+  }
+
+  cw := &fakeCloudWatch{alarmStates: map[string]string{"hc-ok": "OK", "hc-alarm": "ALARM", "hc-data": "INSUFFICIENT_DATA"}}
+  poller := newFakePoller(&fakeRoute53{zones: map[string][]*route53.ResourceRecordSet{"Z1": records}}, cw)
+  serviceConfig := &ServiceConfig{HealthSource: "cloudwatch-batch", ServiceSpecs: []ServiceSpec{{Name: "api", EnvironmentSpecs: environmentSpecs}}}
+  poller.refreshHostedZones(context.Background(), serviceConfig)
+
+  for cycle := 1; cycle <= 2; cycle++ {
+    for _, environment := range poller.poll(context.Background(), serviceConfig, serviceConfig.ServiceSpecs)["api"].Environments {
+      if got := (HealthCheck{environment.Health, environment.Reason}); got != want[environment.Name] {
+        t.Errorf("cycle %d: %s health = %+v, want %+v", cycle, environment.Name, got, want[environment.Name])
+      }
+    }
+    if cw.listCalls != cycle || cw.calls != 0 {
+      t.Errorf("cycle %d: %d DescribeAlarms and %d DescribeAlarmsForMetric calls, want one listing per cycle", cycle, cw.listCalls, cw.calls)
+    }
+  }
+
+  // A failed listing is reported on every instance without listing again
+  cw.err = awserr.New("Throttling", "Rate exceeded", nil)
+  for _, environment := range poller.poll(context.Background(), serviceConfig, serviceConfig.ServiceSpecs)["api"].Environments {
+    instance := environment.Instances[0]
+    if instance.Health != 3 || instance.Reason != "Check Error: Throttling: Rate exceeded" {
+      t.Errorf("%s health = %d %q, want the check error", environment.Name, instance.Health, instance.Reason)
+    }
+  }
+  if cw.listCalls != 3 {
+    t.Errorf("%d DescribeAlarms calls after a failed cycle, want 3", cw.listCalls)
+  }
+}
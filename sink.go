@@ -0,0 +1,176 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "time"
+
+  log "github.com/Sirupsen/logrus"
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/awserr"
+  "github.com/aws/aws-sdk-go/aws/session"
+  "github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Destination for each status snapshot produced by run()
+type Sink interface {
+  Name() string
+  Write(ctx context.Context, output []byte) error
+}
+
+type SinkSpec struct {
+  Type   string
+  Bucket string
+  Key    string
+  Region string
+  Path   string
+}
+
+type S3Sink struct {
+  Bucket string
+  Key    string
+  client S3API
+}
+
+type FileSink struct {
+  Path string
+}
+
+type StdoutSink struct{}
+
+const sinkAttempts = 4
+
+// Delay before the first retry of a failed write, doubled for each later retry
+var sinkBackoff = time.Second
+
+// Builds the sinks listed in the service config
+// Falls back to the legacy S3BucketPost/S3MainPath settings when no sinks are listed
+func newSinks(serviceConfig *ServiceConfig, sessPost *session.Session) ([]Sink, error) {
+  specs := serviceConfig.Sinks
+  if len(specs) == 0 && serviceConfig.S3BucketPost != "" {
+    specs = []SinkSpec{{Type: "s3", Bucket: serviceConfig.S3BucketPost, Key: serviceConfig.S3MainPath}}
+  }
+
+  var sinks []Sink
+  for i, spec := range specs {
+    switch spec.Type {
+    case "s3":
+      if spec.Bucket == "" || spec.Key == "" {
+        return nil, fmt.Errorf("sink %d: s3 sink requires Bucket and Key", i)
+      }
+      sinks = append(sinks, &S3Sink{Bucket: spec.Bucket, Key: spec.Key, client: s3.New(sessPost, s3Config(spec.Region))})
+    case "file":
+      if spec.Path == "" {
+        return nil, fmt.Errorf("sink %d: file sink requires Path", i)
+      }
+      sinks = append(sinks, &FileSink{Path: spec.Path})
+    case "stdout":
+      sinks = append(sinks, &StdoutSink{})
+    default:
+      return nil, fmt.Errorf("sink %d: unknown sink type %q", i, spec.Type)
+    }
+  }
+  return sinks, nil
+}
+
+// Writes the same snapshot to every sink
+// A sink that keeps failing is skipped for this cycle; the next cycle writes a fresh snapshot
+func publish(ctx context.Context, sinks []Sink, output []byte) {
+  for _, sink := range sinks {
+    if err := writeSink(ctx, sink, output); err != nil {
+      log.Error("Error writing status to ", sink.Name(), "; ", err)
+      continue
+    }
+    log.Info("Successfully posted data to ", sink.Name())
+  }
+}
+
+// Retries failed writes with exponential backoff until they succeed, run out of attempts or ctx ends
+func writeSink(ctx context.Context, sink Sink, output []byte) error {
+  backoff := sinkBackoff
+  for attempt := 1; ; attempt++ {
+    err := sink.Write(ctx, output)
+    if err == nil || attempt == sinkAttempts {
+      return err
+    }
+    log.Warn("Writing status to ", sink.Name(), " attempt ", attempt, " failed, retrying in ", backoff, "; ", err)
+    select {
+    case <-time.After(backoff):
+    case <-ctx.Done():
+      return err
+    }
+    backoff *= 2
+  }
+}
+
+func (sink *S3Sink) Name() string {
+  return "s3: " + sink.Bucket + "/" + sink.Key
+}
+
+func (sink *S3Sink) Write(ctx context.Context, output []byte) error {
+  putObjectInput := s3.PutObjectInput{
+    Bucket:      aws.String(sink.Bucket),
+    Key:         aws.String(sink.Key),
+    Body:        bytes.NewReader(output),
+    ContentType: aws.String("application/json"),
+  }
+
+  _, err := sink.client.PutObjectWithContext(ctx, &putObjectInput)
+  if err != nil {
+    if aerr, ok := err.(awserr.Error); ok {
+      log.Info(aerr.Code())
+    }
+    return err
+  }
+  return nil
+}
+
+func (sink *FileSink) Name() string {
+  return "file: " + sink.Path
+}
+
+// Writes to a temporary file and renames it so readers never see a partial snapshot
+func (sink *FileSink) Write(ctx context.Context, output []byte) error {
+  tmp, err := ioutil.TempFile(filepath.Dir(sink.Path), "."+filepath.Base(sink.Path))
+  if err != nil {
+    return err
+  }
+  if _, err := tmp.Write(output); err != nil {
+    tmp.Close()
+    os.Remove(tmp.Name())
+    return err
+  }
+  if err := tmp.Close(); err != nil {
+    os.Remove(tmp.Name())
+    return err
+  }
+  if err := os.Chmod(tmp.Name(), 0644); err != nil {
+    os.Remove(tmp.Name())
+    return err
+  }
+  return os.Rename(tmp.Name(), sink.Path)
+}
+
+func (sink *StdoutSink) Name() string {
+  return "stdout"
+}
+
+// Where logs go: stderr when a stdout sink is configured, so the snapshots on stdout aren't mixed with log lines
+func logOutput(sinks []Sink) io.Writer {
+  for _, sink := range sinks {
+    if _, ok := sink.(*StdoutSink); ok {
+      return os.Stderr
+    }
+  }
+  return os.Stdout
+}
+
+func (sink *StdoutSink) Write(ctx context.Context, output []byte) error {
+  _, err := os.Stdout.Write(append(output, '\n'))
+  return err
+}
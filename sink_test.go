@@ -0,0 +1,160 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestS3SinkWrite(t *testing.T) {
+  tests := []struct {
+    name    string
+    err     error
+    wantErr bool
+  }{
+    {"uploaded", nil, false},
+    {"upload failure", errors.New("AccessDenied"), true},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      client := &fakeS3{err: test.err}
+      sink := &S3Sink{Bucket: "status", Key: "main.json", client: client}
+      err := sink.Write(context.Background(), []byte(`{"api":{}}`))
+      if (err != nil) != test.wantErr {
+        t.Fatalf("err = %v, wantErr %v", err, test.wantErr)
+      }
+      if !test.wantErr && string(client.objects["status/main.json"]) != `{"api":{}}` {
+        t.Errorf("uploaded %q", client.objects["status/main.json"])
+      }
+    })
+  }
+}
+
+// Fails as many writes as failures before succeeding
+type flakySink struct {
+  failures int
+  writes   int
+}
+
+func (sink *flakySink) Name() string {
+  return "flaky"
+}
+
+func (sink *flakySink) Write(ctx context.Context, output []byte) error {
+  sink.writes++
+  if sink.writes <= sink.failures {
+    return errors.New("unavailable")
+  }
+  return nil
+}
+
+func TestWriteSinkRetries(t *testing.T) {
+  defer func(backoff time.Duration) { sinkBackoff = backoff }(sinkBackoff)
+  sinkBackoff = time.Millisecond
+
+  tests := []struct {
+    name       string
+    failures   int
+    wantWrites int
+    wantErr    bool
+  }{
+    {"first attempt", 0, 1, false},
+    {"recovers", 2, 3, false},
+    {"gives up", 10, sinkAttempts, true},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      sink := &flakySink{failures: test.failures}
+      err := writeSink(context.Background(), sink, []byte(`{}`))
+      if (err != nil) != test.wantErr {
+        t.Errorf("err = %v, wantErr %v", err, test.wantErr)
+      }
+      if sink.writes != test.wantWrites {
+        t.Errorf("wrote %d times, want %d", sink.writes, test.wantWrites)
+      }
+    })
+  }
+}
+
+func TestPublishContinuesAfterFailure(t *testing.T) {
+  defer func(backoff time.Duration) { sinkBackoff = backoff }(sinkBackoff)
+  sinkBackoff = time.Millisecond
+
+  failing := &S3Sink{Bucket: "status", Key: "main.json", client: &fakeS3{err: errors.New("AccessDenied")}}
+  working := &fakeS3{}
+  publish(context.Background(), []Sink{failing, &S3Sink{Bucket: "status", Key: "copy.json", client: working}}, []byte(`{}`))
+  if string(working.objects["status/copy.json"]) != `{}` {
+    t.Error("snapshot not written to the sink after the failing one")
+  }
+}
+
+func TestFileSinkWrite(t *testing.T) {
+  dir, err := ioutil.TempDir("", "sink")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  sink := &FileSink{Path: filepath.Join(dir, "status.json")}
+  if err := sink.Write(context.Background(), []byte(`{}`)); err != nil {
+    t.Fatal(err)
+  }
+  if data, _ := ioutil.ReadFile(sink.Path); string(data) != `{}` {
+    t.Errorf("wrote %q", data)
+  }
+
+  missing := &FileSink{Path: filepath.Join(dir, "missing", "status.json")}
+  if err := missing.Write(context.Background(), []byte(`{}`)); err == nil {
+    t.Error("write to a missing directory succeeded")
+  }
+}
+
+func TestNewSinks(t *testing.T) {
+  tests := []struct {
+    name    string
+    config  ServiceConfig
+    names   []string
+    wantErr bool
+  }{
+    {"legacy s3 settings", ServiceConfig{S3BucketPost: "status", S3MainPath: "main.json"}, []string{"s3: status/main.json"}, false},
+    {"listed sinks", ServiceConfig{Sinks: []SinkSpec{{Type: "file", Path: "/tmp/status.json"}, {Type: "stdout"}}}, []string{"file: /tmp/status.json", "stdout"}, false},
+    {"s3 without key", ServiceConfig{Sinks: []SinkSpec{{Type: "s3", Bucket: "status"}}}, nil, true},
+    {"unknown type", ServiceConfig{Sinks: []SinkSpec{{Type: "ftp"}}}, nil, true},
+  }
+
+  sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1")}))
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      sinks, err := newSinks(&test.config, sess)
+      if (err != nil) != test.wantErr {
+        t.Fatalf("err = %v, wantErr %v", err, test.wantErr)
+      }
+      if len(sinks) != len(test.names) {
+        t.Fatalf("got %d sinks, want %d", len(sinks), len(test.names))
+      }
+      for i, sink := range sinks {
+        if sink.Name() != test.names[i] {
+          t.Errorf("sink %d = %s, want %s", i, sink.Name(), test.names[i])
+        }
+      }
+    })
+  }
+}
+
+func TestLogOutput(t *testing.T) {
+  if logOutput([]Sink{&FileSink{Path: "/tmp/status.json"}}) != os.Stdout {
+    t.Error("logs moved off stdout without a stdout sink")
+  }
+  if logOutput([]Sink{&FileSink{Path: "/tmp/status.json"}, &StdoutSink{}}) != os.Stderr {
+    t.Error("logs share stdout with the stdout sink")
+  }
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+  "sync/atomic"
+  "time"
+
+  "github.com/aws/aws-sdk-go/service/route53"
+)
+
+// Hosted zones from one refresh, published whole and never modified afterwards
+type ZoneSnapshot struct {
+  Zones   map[ZoneKey][]*route53.ResourceRecordSet
+  Fetched map[ZoneKey]time.Time
+}
+
+// State shared by the refresh loop, the run loop and the HTTP server
+// Every value is an immutable snapshot replaced by atomic swap, so readers never lock or see half an update
+type StateStore struct {
+  config     atomic.Value
+  zones      atomic.Value
+  discovered atomic.Value
+  status     atomic.Value
+}
+
+var emptyZoneSnapshot = &ZoneSnapshot{}
+
+var state = &StateStore{}
+
+// Nil until the config file is first loaded
+func (store *StateStore) Config() *LoadedConfig {
+  config, _ := store.config.Load().(*LoadedConfig)
+  return config
+}
+
+func (store *StateStore) storeConfig(config *LoadedConfig) {
+  store.config.Store(config)
+}
+
+func (store *StateStore) Zones() *ZoneSnapshot {
+  if zones, ok := store.zones.Load().(*ZoneSnapshot); ok {
+    return zones
+  }
+  return emptyZoneSnapshot
+}
+
+func (store *StateStore) storeZones(zones *ZoneSnapshot) {
+  store.zones.Store(zones)
+}
+
+func (store *StateStore) DiscoveredServices() []ServiceSpec {
+  discovered, _ := store.discovered.Load().([]ServiceSpec)
+  return discovered
+}
+
+func (store *StateStore) storeDiscoveredServices(discovered []ServiceSpec) {
+  store.discovered.Store(discovered)
+}
+
+// Nil until the first run completes
+func (store *StateStore) Status() *Snapshot {
+  snapshot, _ := store.status.Load().(*Snapshot)
+  return snapshot
+}
+
+func (store *StateStore) storeStatus(snapshot *Snapshot) {
+  store.status.Store(snapshot)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "net/http/httptest"
+  "sync"
+  "testing"
+
+  "github.com/aws/aws-sdk-go/service/route53"
+)
+
+func TestStateStoreDefaults(t *testing.T) {
+  store := &StateStore{}
+  if zones := store.Zones(); zones == nil || len(zones.Zones) != 0 {
+    t.Errorf("zones = %+v, want an empty snapshot", zones)
+  }
+  if store.Config() != nil || store.DiscoveredServices() != nil || store.Status() != nil {
+    t.Error("empty store returned a config, discovered services or status")
+  }
+
+  store.storeDiscoveredServices([]ServiceSpec{{Name: "api"}})
+  store.storeDiscoveredServices(nil)
+  if store.DiscoveredServices() != nil {
+    t.Errorf("discovered = %v, want none after clearing", store.DiscoveredServices())
+  }
+}
+
+// Refreshes, polls and serves status at the same time, as main does; run with -race
+func TestConcurrentRefreshPollAndServe(t *testing.T) {
+  r53 := &fakeRoute53{
+    zones: map[string][]*route53.ResourceRecordSet{"Z1": {
+      latencyRecord("api.example.com.", "us-east-1", "hc-1"),
+      latencyRecord("api.example.com.", "eu-west-1", "hc-2"),
+    }},
+    throttledCalls: map[string]int{"Z1": 3},
+  }
+  cw := &fakeCloudWatch{alarmStates: map[string]string{"hc-1": "OK", "hc-2": "ALARM"}}
+  serviceConfig := &ServiceConfig{ServiceSpecs: []ServiceSpec{{
+    Name: "api",
+    EnvironmentSpecs: []EnvironmentSpec{
+      {Name: "prod", HostedZoneId: "Z1", DomainName: "api.example.com"},
+      {Name: "worst", HostedZoneId: "Z1", DomainName: "api.example.com", Aggregation: AggregationSpec{Policy: "worst"}},
+    },
+  }}}
+
+  defer func(previous *Poller) { poller = previous }(poller)
+  poller = newFakePoller(r53, cw)
+  poller.refreshHostedZones(context.Background(), serviceConfig)
+
+  var wg sync.WaitGroup
+  wg.Add(3)
+  go func() {
+    defer wg.Done()
+    for i := 0; i < 20; i++ {
+      poller.refreshHostedZones(context.Background(), serviceConfig)
+    }
+  }()
+  go func() {
+    defer wg.Done()
+    for i := 0; i < 20; i++ {
+      services := poller.poll(context.Background(), serviceConfig, mergeServiceSpecs(serviceConfig.ServiceSpecs, poller.state.DiscoveredServices()))
+      output, err := json.Marshal(services)
+      if err != nil {
+        t.Error(err)
+        return
+      }
+      storeSnapshot(services, output)
+    }
+  }()
+  go func() {
+    defer wg.Done()
+    for i := 0; i < 20; i++ {
+      statusHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/status/api/prod", nil))
+      metricsHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+    }
+  }()
+  wg.Wait()
+
+  environments := loadSnapshot().Services["api"].Environments
+  if environments[0].Health != 0 || environments[1].Health != 2 {
+    t.Errorf("health = %d, %d; want 0, 2", environments[0].Health, environments[1].Health)
+  }
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+  "crypto/sha1"
+  "encoding/hex"
+  "encoding/json"
+  "net/http"
+  "strings"
+  "time"
+
+  log "github.com/Sirupsen/logrus"
+)
+
+// Most recent output of run(), kept for the embedded HTTP server
+type Snapshot struct {
+  Services map[string]Service
+  Body     []byte
+  Modified time.Time
+}
+
+// services and output must not be modified once stored
+func storeSnapshot(services map[string]Service, output []byte) {
+  state.storeStatus(&Snapshot{Services: services, Body: output, Modified: time.Now().UTC().Truncate(time.Second)})
+}
+
+func loadSnapshot() *Snapshot {
+  return state.Status()
+}
+
+func startHTTPServer(addr string) {
+  mux := http.NewServeMux()
+  mux.HandleFunc("/status", statusHandler)
+  mux.HandleFunc("/status/", statusHandler)
+  mux.HandleFunc("/metrics", metricsHandler)
+
+  log.Info("Serving status API and metrics on ", addr)
+  go func() {
+    if err := http.ListenAndServe(addr, mux); err != nil {
+      log.Fatal("HTTP server stopped; ", err)
+    }
+  }()
+}
+
+// Serves /status, /status/{service} and /status/{service}/{env} from the latest snapshot
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodGet && r.Method != http.MethodHead {
+    w.Header().Set("Allow", "GET, HEAD")
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+
+  snapshot := loadSnapshot()
+  if snapshot == nil {
+    http.Error(w, "no status available yet", http.StatusServiceUnavailable)
+    return
+  }
+
+  var parts []string
+  if path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/status"), "/"); path != "" {
+    parts = strings.Split(path, "/")
+  }
+
+  body := snapshot.Body
+  switch len(parts) {
+  case 0:
+  case 1, 2:
+    service, ok := snapshot.Services[parts[0]]
+    if !ok {
+      http.NotFound(w, r)
+      return
+    }
+    var value interface{} = service
+    if len(parts) == 2 {
+      environment, ok := findEnvironment(&service, parts[1])
+      if !ok {
+        http.NotFound(w, r)
+        return
+      }
+      value = environment
+    }
+    var err error
+    body, err = json.Marshal(value)
+    if err != nil {
+      log.Error("Unable to create JSON output", err)
+      http.Error(w, "unable to encode status", http.StatusInternalServerError)
+      return
+    }
+  default:
+    http.NotFound(w, r)
+    return
+  }
+
+  sum := sha1.Sum(body)
+  etag := `"` + hex.EncodeToString(sum[:]) + `"`
+  w.Header().Set("ETag", etag)
+  w.Header().Set("Last-Modified", snapshot.Modified.Format(http.TimeFormat))
+  w.Header().Set("Cache-Control", "no-cache")
+  w.Header().Set("Content-Type", "application/json")
+
+  if notModified(r, etag, snapshot.Modified) {
+    w.WriteHeader(http.StatusNotModified)
+    return
+  }
+  if r.Method == http.MethodHead {
+    return
+  }
+  w.Write(body)
+}
+
+func findEnvironment(service *Service, name string) (Environment, bool) {
+  for _, environment := range service.Environments {
+    if environment.Name == name {
+      return environment, true
+    }
+  }
+  return Environment{}, false
+}
+
+// If-None-Match takes precedence over If-Modified-Since as in RFC 7232
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+  if match := r.Header.Get("If-None-Match"); match != "" {
+    for _, candidate := range strings.Split(match, ",") {
+      candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+      if candidate == etag || candidate == "*" {
+        return true
+      }
+    }
+    return false
+  }
+  if since := r.Header.Get("If-Modified-Since"); since != "" {
+    if t, err := http.ParseTime(since); err == nil {
+      return !modified.After(t)
+    }
+  }
+  return false
+}
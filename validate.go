@@ -0,0 +1,461 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "net/url"
+  "os"
+  "reflect"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// A problem found in the config file, located by its field path and line
+type ConfigProblem struct {
+  Line    int
+  Path    string
+  Message string
+}
+
+func (problem ConfigProblem) Error() string {
+  var prefix string
+  if problem.Line > 0 {
+    prefix = "line " + strconv.Itoa(problem.Line) + ": "
+  }
+  if problem.Path != "" {
+    prefix += problem.Path + ": "
+  }
+  return prefix + problem.Message
+}
+
+type configProblems []ConfigProblem
+
+func (problems configProblems) Error() string {
+  messages := make([]string, len(problems))
+  for i, problem := range problems {
+    messages[i] = problem.Error()
+  }
+  return strings.Join(messages, "; ")
+}
+
+var hostedZoneIdPattern = regexp.MustCompile(`^(/hostedzone/)?[A-Z0-9]{1,32}$`)
+var domainLabelPattern = regexp.MustCompile(`^(\*|[A-Za-z0-9_]([A-Za-z0-9_-]{0,61}[A-Za-z0-9_])?)$`)
+
+var route53RecordTypes = []string{"A", "AAAA", "CAA", "CNAME", "MX", "NAPTR", "NS", "PTR", "SOA", "SPF", "SRV", "TXT"}
+
+// Entry point for `route53-healthcheck-status validate [path]`
+// Prints every problem with its line and returns the process exit code
+func runValidate(args []string) int {
+  path := os.Getenv("CONFIG_PATH")
+  if len(args) > 0 {
+    path = args[0]
+  }
+  if path == "" {
+    fmt.Fprintln(os.Stderr, "usage: route53-healthcheck-status validate <config path>")
+    return 2
+  }
+
+  data, err := ioutil.ReadFile(path)
+  if err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    return 1
+  }
+  if _, problems := parseServiceConfig(path, data); len(problems) > 0 {
+    for _, problem := range problems {
+      if problem.Line > 0 {
+        fmt.Fprintf(os.Stderr, "%s:%d: ", path, problem.Line)
+      } else {
+        fmt.Fprintf(os.Stderr, "%s: ", path)
+      }
+      if problem.Path != "" {
+        fmt.Fprintf(os.Stderr, "%s: ", problem.Path)
+      }
+      fmt.Fprintln(os.Stderr, problem.Message)
+    }
+    return 1
+  }
+  fmt.Println(path + ": OK")
+  return 0
+}
+
+// Decodes the JSON or YAML config strictly, rejecting unknown fields, then checks its contents
+// YAML is converted to JSON first so both formats share the same field mapping and rules
+func parseServiceConfig(path string, data []byte) (*ServiceConfig, configProblems) {
+  var raw interface{}
+  var lines map[string]int
+  yamlConfig := isYAMLConfig(path, data)
+  if yamlConfig {
+    var problems configProblems
+    raw, lines, problems = decodeYAMLConfig(data)
+    if len(problems) > 0 {
+      return nil, problems
+    }
+    var err error
+    if data, err = json.Marshal(raw); err != nil {
+      return nil, configProblems{{Message: err.Error()}}
+    }
+  } else {
+    if err := json.Unmarshal(data, &raw); err != nil {
+      if syntaxErr, ok := err.(*json.SyntaxError); ok {
+        return nil, configProblems{{Line: lineAt(data, syntaxErr.Offset), Message: syntaxErr.Error()}}
+      }
+      return nil, configProblems{{Message: err.Error()}}
+    }
+    lines = indexJSONLines(data)
+  }
+
+  var problems configProblems
+  checkKnownFields(raw, reflect.TypeOf(ServiceConfig{}), "", &problems)
+
+  var serviceConfig ServiceConfig
+  if err := json.Unmarshal(data, &serviceConfig); err != nil {
+    if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+      problem := ConfigProblem{Path: jsonFieldPath(typeErr.Field), Message: "expected " + typeErr.Type.String() + ", found " + typeErr.Value}
+      // Offsets into the converted YAML don't correspond to lines in the file
+      if !yamlConfig {
+        problem.Line = lineAt(data, typeErr.Offset)
+      }
+      problems = append(problems, problem)
+    } else {
+      problems = append(problems, ConfigProblem{Message: err.Error()})
+    }
+  } else {
+    problems = append(problems, checkServiceConfig(&serviceConfig)...)
+  }
+
+  for i := range problems {
+    if problems[i].Line == 0 {
+      problems[i].Line = lookupLine(lines, problems[i].Path)
+    }
+  }
+  sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+  if len(problems) > 0 {
+    return nil, problems
+  }
+  return &serviceConfig, nil
+}
+
+// Reports keys that don't match a field, matching case-insensitively like encoding/json
+func checkKnownFields(value interface{}, t reflect.Type, path string, problems *configProblems) {
+  for t.Kind() == reflect.Ptr {
+    t = t.Elem()
+  }
+  switch t.Kind() {
+  case reflect.Struct:
+    object, ok := value.(map[string]interface{})
+    if !ok {
+      return
+    }
+    for key, child := range object {
+      field, ok := fieldByJSONName(t, key)
+      if !ok {
+        *problems = append(*problems, ConfigProblem{Path: joinPath(path, key), Message: "unknown field"})
+        continue
+      }
+      checkKnownFields(child, field.Type, joinPath(path, key), problems)
+    }
+  case reflect.Slice:
+    array, ok := value.([]interface{})
+    if !ok {
+      return
+    }
+    for i, child := range array {
+      checkKnownFields(child, t.Elem(), path+"["+strconv.Itoa(i)+"]", problems)
+    }
+  }
+}
+
+func fieldByJSONName(t reflect.Type, key string) (reflect.StructField, bool) {
+  for i := 0; i < t.NumField(); i++ {
+    field := t.Field(i)
+    if field.PkgPath != "" {
+      continue
+    }
+    name := strings.Split(field.Tag.Get("json"), ",")[0]
+    if name == "-" {
+      continue
+    }
+    if name == "" {
+      name = field.Name
+    }
+    if strings.EqualFold(name, key) {
+      return field, true
+    }
+  }
+  return reflect.StructField{}, false
+}
+
+func joinPath(path string, key string) string {
+  if path == "" {
+    return key
+  }
+  return path + "." + key
+}
+
+func checkServiceConfig(serviceConfig *ServiceConfig) configProblems {
+  var problems configProblems
+  problem := func(path string, format string, args ...interface{}) {
+    problems = append(problems, ConfigProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+  }
+
+  // A config without services or sinks loads fine but never publishes anything
+  if len(serviceConfig.ServiceSpecs) == 0 && serviceConfig.Discovery == nil {
+    problem("", "Services or Discovery is required")
+  }
+  if len(serviceConfig.Sinks) == 0 {
+    switch {
+    case serviceConfig.S3BucketPost == "" && serviceConfig.S3MainPath == "":
+      problem("", "Sinks, or S3BucketPost and S3MainPath, are required")
+    case serviceConfig.S3BucketPost == "":
+      problem("S3MainPath", "S3BucketPost is required with S3MainPath")
+    case serviceConfig.S3MainPath == "":
+      problem("S3BucketPost", "S3MainPath is required with S3BucketPost")
+    }
+  }
+
+  if !validHealthSource(serviceConfig.HealthSource) {
+    problem("HealthSource", "unknown health source %q", serviceConfig.HealthSource)
+  }
+
+  if serviceConfig.Discovery != nil {
+    if err := serviceConfig.Discovery.validate(); err != nil {
+      problem("Discovery", "%v", err)
+    }
+  }
+
+  for i, sink := range serviceConfig.Sinks {
+    path := fmt.Sprintf("Sinks[%d]", i)
+    switch sink.Type {
+    case "s3":
+      if sink.Bucket == "" {
+        problem(path, "s3 sink requires Bucket")
+      }
+      if sink.Key == "" {
+        problem(path, "s3 sink requires Key")
+      }
+    case "file":
+      if sink.Path == "" {
+        problem(path, "file sink requires Path")
+      }
+    case "stdout":
+    default:
+      problem(path+".Type", "unknown sink type %q", sink.Type)
+    }
+  }
+
+  serviceNames := make(map[string]int)
+  for i, serviceSpec := range serviceConfig.ServiceSpecs {
+    path := fmt.Sprintf("Services[%d]", i)
+    if serviceSpec.Name == "" {
+      problem(path, "Name is required")
+    } else if first, ok := serviceNames[serviceSpec.Name]; ok {
+      problem(path+".Name", "duplicate service name %q, first used by Services[%d]", serviceSpec.Name, first)
+    } else {
+      serviceNames[serviceSpec.Name] = i
+    }
+    if !validHealthSource(serviceSpec.HealthSource) {
+      problem(path+".HealthSource", "unknown health source %q", serviceSpec.HealthSource)
+    }
+    if serviceSpec.Account != nil {
+      if err := serviceSpec.Account.validate(); err != nil {
+        problem(path+".Account", "%v", err)
+      }
+    }
+
+    for j, webhook := range serviceSpec.Webhooks {
+      webhookPath := fmt.Sprintf("%s.Webhooks[%d]", path, j)
+      if u, err := url.Parse(webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        problem(webhookPath+".URL", "invalid webhook URL %q", webhook.URL)
+      }
+      if _, err := parseWebhookTemplate(&webhook); err != nil {
+        problem(webhookPath+".Template", "%v", err)
+      }
+    }
+
+    if len(serviceSpec.EnvironmentSpecs) == 0 {
+      problem(path, "Environments is required")
+    }
+
+    environmentNames := make(map[string]int)
+    for j, environmentSpec := range serviceSpec.EnvironmentSpecs {
+      environmentPath := fmt.Sprintf("%s.Environments[%d]", path, j)
+      if environmentSpec.Name == "" {
+        problem(environmentPath, "Name is required")
+      } else if first, ok := environmentNames[environmentSpec.Name]; ok {
+        problem(environmentPath+".Name", "duplicate environment name %q, first used by %s.Environments[%d]", environmentSpec.Name, path, first)
+      } else {
+        environmentNames[environmentSpec.Name] = j
+      }
+
+      if environmentSpec.HostedZoneId == "" {
+        problem(environmentPath, "HostedZoneId is required")
+      } else if !hostedZoneIdPattern.MatchString(environmentSpec.HostedZoneId) {
+        problem(environmentPath+".HostedZoneId", "invalid hosted zone id %q", environmentSpec.HostedZoneId)
+      }
+
+      if environmentSpec.DomainName == "" {
+        problem(environmentPath, "DomainName is required")
+      } else if err := checkDomainName(environmentSpec.DomainName); err != nil {
+        problem(environmentPath+".DomainName", "%v", err)
+      }
+
+      for k, recordType := range environmentSpec.RecordTypes {
+        if !containsString(route53RecordTypes, recordType) {
+          problem(fmt.Sprintf("%s.RecordTypes[%d]", environmentPath, k), "unknown record type %q", recordType)
+        }
+      }
+
+      if err := environmentSpec.Aggregation.validate(); err != nil {
+        problem(environmentPath+".Aggregation", "%v", err)
+      }
+      if environmentSpec.Account != nil {
+        if err := environmentSpec.Account.validate(); err != nil {
+          problem(environmentPath+".Account", "%v", err)
+        }
+      }
+    }
+  }
+  return problems
+}
+
+// Domain names are written without the trailing dot Route53 adds to record names
+func checkDomainName(domainName string) error {
+  if strings.HasSuffix(domainName, ".") {
+    return fmt.Errorf("domain name %q must not end with a dot", domainName)
+  }
+  if len(domainName) > 253 {
+    return fmt.Errorf("domain name %q is longer than 253 characters", domainName)
+  }
+  for i, label := range strings.Split(domainName, ".") {
+    if !domainLabelPattern.MatchString(label) || (label == "*" && i > 0) {
+      return fmt.Errorf("invalid label %q in domain name %q", label, domainName)
+    }
+  }
+  return nil
+}
+
+func lineAt(data []byte, offset int64) int {
+  if offset > int64(len(data)) {
+    offset = int64(len(data))
+  }
+  return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// Finds the line of the closest enclosing path that appears in the file
+func lookupLine(lines map[string]int, path string) int {
+  path = strings.ToLower(path)
+  for path != "" {
+    if line, ok := lines[path]; ok {
+      return line
+    }
+    cut := strings.LastIndexAny(path, ".[")
+    if cut < 0 {
+      break
+    }
+    path = path[:cut]
+  }
+  return 0
+}
+
+// Maps the lower-cased path of every value in a syntactically valid JSON document to the line it starts on
+func indexJSONLines(data []byte) map[string]int {
+  indexer := jsonLineIndexer{data: data, line: 1, lines: make(map[string]int)}
+  indexer.value("")
+  return indexer.lines
+}
+
+type jsonLineIndexer struct {
+  data  []byte
+  pos   int
+  line  int
+  lines map[string]int
+}
+
+func (ix *jsonLineIndexer) skipSpace() {
+  for ix.pos < len(ix.data) {
+    switch ix.data[ix.pos] {
+    case '\n':
+      ix.line++
+    case ' ', '\t', '\r':
+    default:
+      return
+    }
+    ix.pos++
+  }
+}
+
+func (ix *jsonLineIndexer) value(path string) {
+  ix.skipSpace()
+  if ix.pos >= len(ix.data) {
+    return
+  }
+  if path != "" {
+    ix.lines[path] = ix.line
+  }
+
+  switch ix.data[ix.pos] {
+  case '{':
+    ix.pos++
+    for {
+      ix.skipSpace()
+      if ix.pos >= len(ix.data) || ix.data[ix.pos] == '}' {
+        ix.pos++
+        return
+      }
+      if ix.data[ix.pos] == ',' {
+        ix.pos++
+        continue
+      }
+      keyLine := ix.line
+      key := ix.str()
+      ix.skipSpace()
+      ix.pos++ // colon
+      childPath := joinPath(path, strings.ToLower(key))
+      ix.value(childPath)
+      // Point at the key rather than a value starting on a later line
+      ix.lines[childPath] = keyLine
+    }
+  case '[':
+    ix.pos++
+    for i := 0; ; {
+      ix.skipSpace()
+      if ix.pos >= len(ix.data) || ix.data[ix.pos] == ']' {
+        ix.pos++
+        return
+      }
+      if ix.data[ix.pos] == ',' {
+        ix.pos++
+        i++
+        continue
+      }
+      ix.value(path + "[" + strconv.Itoa(i) + "]")
+    }
+  case '"':
+    ix.str()
+  default:
+    for ix.pos < len(ix.data) && !strings.ContainsRune(",}] \t\r\n", rune(ix.data[ix.pos])) {
+      ix.pos++
+    }
+  }
+}
+
+func (ix *jsonLineIndexer) str() string {
+  start := ix.pos
+  ix.pos++
+  for ix.pos < len(ix.data) && ix.data[ix.pos] != '"' {
+    if ix.data[ix.pos] == '\\' {
+      ix.pos++
+    }
+    ix.pos++
+  }
+  ix.pos++
+  var s string
+  if err := json.Unmarshal(ix.data[start:ix.pos], &s); err != nil {
+    return string(ix.data[start:ix.pos])
+  }
+  return s
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+  "reflect"
+  "testing"
+)
+
+func TestParseServiceConfig(t *testing.T) {
+  tests := []struct {
+    name     string
+    path     string
+    config   string
+    problems []string
+  }{
+    {"valid json", "config.json", `{
+  "Sinks": [{"Type": "stdout"}],
+  "Services": [
+    {"Name": "api", "Environments": [{"Name": "prod", "HostedZoneId": "Z1", "DomainName": "api.example.com"}]}
+  ]
+}`, nil},
+    {"valid yaml", "config.yaml", `S3BucketPost: status
+S3MainPath: main.json
+Services:
+  - Name: api
+    Environments:
+      - Name: prod
+        HostedZoneId: /hostedzone/Z1
+        DomainName: api.example.com
+`, nil},
+    {"empty json object", "config.json", `{}`, []string{
+      "Services or Discovery is required",
+      "Sinks, or S3BucketPost and S3MainPath, are required",
+    }},
+    {"empty yaml file", "config.yaml", ``, []string{
+      "Services or Discovery is required",
+      "Sinks, or S3BucketPost and S3MainPath, are required",
+    }},
+    {"json syntax error", "config.json", `{
+  "Sinks": [{"Type": "stdout"}],
+  "Services": [
+}`, []string{"line 4: invalid character '}' looking for beginning of value"}},
+    {"json problems", "config.json", `{
+  "S3BucketPost": "status",
+  "Services": [
+    {
+      "Name": "api",
+      "Environments": [
+        {
+          "Name": "prod",
+          "HostedZoneId": "not a zone",
+          "DomainName": "api.example.com.",
+          "Colour": "blue"
+        }
+      ]
+    },
+    {"Name": "api", "Environments": []}
+  ]
+}`, []string{
+      "line 2: S3BucketPost: S3MainPath is required with S3BucketPost",
+      "line 9: Services[0].Environments[0].HostedZoneId: invalid hosted zone id \"not a zone\"",
+      "line 10: Services[0].Environments[0].DomainName: domain name \"api.example.com.\" must not end with a dot",
+      "line 11: Services[0].Environments[0].Colour: unknown field",
+      "line 15: Services[1].Name: duplicate service name \"api\", first used by Services[0]",
+      "line 15: Services[1]: Environments is required",
+    }},
+    {"json type error", "config.json", `{
+  "Sinks": [{"Type": "stdout"}],
+  "Services": [
+    {"Name": "api", "Environments": [{"Name": 7, "HostedZoneId": "Z1", "DomainName": "api.example.com"}]}
+  ]
+}`, []string{"line 4: Services[0].Environments[0].Name: expected string, found number"}},
+    {"yaml syntax error", "config.yaml", `Sinks:
+  - Type: stdout
+Services: [
+`, []string{"line 3: did not find expected node content"}},
+    {"yaml problems", "config.yml", `Sinks:
+  - Type: ftp
+Services:
+  - Name: api
+    HealthSource: pingdom
+    Environments:
+      - Name: prod
+        HostedZoneId: Z1
+        DomainName: api.example.com
+        RecordTypes: [A, XYZ]
+      - Name: prod
+        HostedZoneId: Z1
+`, []string{
+      "line 2: Sinks[0].Type: unknown sink type \"ftp\"",
+      "line 5: Services[0].HealthSource: unknown health source \"pingdom\"",
+      "line 10: Services[0].Environments[0].RecordTypes[1]: unknown record type \"XYZ\"",
+      "line 11: Services[0].Environments[1].Name: duplicate environment name \"prod\", first used by Services[0].Environments[0]",
+      "line 11: Services[0].Environments[1]: DomainName is required",
+    }},
+    {"yaml duplicate key", "config.yaml", `Sinks:
+  - Type: stdout
+Services:
+  - Name: api
+    Name: web
+`, []string{"line 5: Services[0].Name: duplicate key"}},
+    {"yaml shared anchor", "config.yaml", `Sinks:
+  - Type: stdout
+Services:
+  - Name: api
+    Environments: &environments
+      - Name: prod
+        HostedZoneId: Z1
+        DomainName: example.com
+  - Name: web
+    Environments: *environments
+`, nil},
+    {"yaml merge keys", "config.yaml", `Sinks:
+  - Type: stdout
+Services:
+  - Name: api
+    Environments:
+      - &base
+        Name: prod
+        HostedZoneId: Z1
+        DomainName: api.example.com
+      - <<: *base
+        Name: stage
+      - <<: [{DomainName: stage.example.com}, *base]
+        Name: canary
+`, nil},
+    {"yaml merge key problems", "config.yaml", `Sinks:
+  - Type: stdout
+Services:
+  - Name: api
+    Environments:
+      - &base
+        Name: prod
+        HostedZoneId: Z1
+        DomainName: api.example.com
+      - <<: *base
+        Name: stage
+        DomainName: stage.example.com.
+      - <<: *base
+        HostedZoneId: bad zone
+`, []string{
+      // Merged fields are reported where the anchor wrote them
+      "line 7: Services[0].Environments[2].Name: duplicate environment name \"prod\", first used by Services[0].Environments[0]",
+      "line 12: Services[0].Environments[1].DomainName: domain name \"stage.example.com.\" must not end with a dot",
+      "line 14: Services[0].Environments[2].HostedZoneId: invalid hosted zone id \"bad zone\"",
+    }},
+    {"yaml merge of a scalar", "config.yaml", `Sinks:
+  - Type: stdout
+Services:
+  - <<: production
+    Name: api
+`, []string{"line 4: Services[0]: merge key needs a mapping or a list of mappings"}},
+    {"yaml recursive alias", "config.yaml", `Sinks:
+  - Type: stdout
+Services: &services
+  - Name: api
+    Environments: *services
+`, []string{"line 5: Services[0].Environments: alias *services refers to its own anchor"}},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      serviceConfig, problems := parseServiceConfig(test.path, []byte(test.config))
+      var got []string
+      for _, problem := range problems {
+        got = append(got, problem.Error())
+      }
+      if !reflect.DeepEqual(got, test.problems) {
+        t.Errorf("problems = %q, want %q", got, test.problems)
+      }
+      if (serviceConfig == nil) != (len(test.problems) > 0) {
+        t.Errorf("config = %v with %d problems", serviceConfig, len(problems))
+      }
+    })
+  }
+}
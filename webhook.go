@@ -0,0 +1,209 @@
+package main
+
+import (
+  "bytes"
+  "crypto/sha1"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "strconv"
+  "sync"
+  "text/template"
+  "time"
+
+  log "github.com/Sirupsen/logrus"
+)
+
+// Endpoint notified when an environment of the service changes health
+// Template is a Go text/template rendered with a Notification; the default is its JSON encoding
+type WebhookSpec struct {
+  URL         string
+  Template    string            `json:",omitempty"`
+  ContentType string            `json:",omitempty"`
+  Headers     map[string]string `json:",omitempty"`
+}
+
+type Notification struct {
+  Id             string
+  Service        string
+  DisplayName    string
+  Environment    string
+  PreviousHealth int
+  Health         int
+  Reason         string
+  Time           time.Time
+}
+
+type delivery struct {
+  webhook      WebhookSpec
+  notification Notification
+}
+
+// Sends environment transitions to webhooks, in order, from a single worker
+type Notifier struct {
+  mu        sync.Mutex
+  previous  map[string]Transition
+  delivered map[string]int
+  queue     chan delivery
+  client    *http.Client
+}
+
+const (
+  webhookAttempts  = 4
+  webhookBackoff   = time.Second
+  webhookQueueSize = 256
+  webhookTimeout   = 10 * time.Second
+)
+
+var webhookFuncs = template.FuncMap{
+  "json": func(v interface{}) (string, error) {
+    output, err := json.Marshal(v)
+    return string(output), err
+  },
+}
+
+var notifier *Notifier
+
+func newNotifier() *Notifier {
+  notifier := &Notifier{
+    delivered: make(map[string]int),
+    queue:     make(chan delivery, webhookQueueSize),
+    client:    &http.Client{Timeout: webhookTimeout},
+  }
+  go notifier.work()
+  return notifier
+}
+
+func parseWebhookTemplate(webhook *WebhookSpec) (*template.Template, error) {
+  if webhook.Template == "" {
+    return nil, nil
+  }
+  return template.New(webhook.URL).Funcs(webhookFuncs).Parse(webhook.Template)
+}
+
+// Compares the snapshot with the previous one and queues a delivery per webhook for each environment that changed
+// The first snapshot only sets the baseline, so restarts don't re-announce every environment
+func (notifier *Notifier) Notify(serviceSpecs []ServiceSpec, services map[string]Service, now time.Time) {
+  notifier.mu.Lock()
+  defer notifier.mu.Unlock()
+
+  first := notifier.previous == nil
+  if first {
+    notifier.previous = make(map[string]Transition)
+  }
+
+  webhooks := make(map[string][]WebhookSpec)
+  for _, serviceSpec := range serviceSpecs {
+    webhooks[serviceSpec.Name] = serviceSpec.Webhooks
+  }
+
+  for _, transition := range stateTransitions(notifier.previous, services, now) {
+    key := historyKey(transition.Service, transition.Environment, transition.Instance)
+    previous, seen := notifier.previous[key]
+    notifier.previous[key] = transition
+    if first || !seen || transition.Instance != "" {
+      continue
+    }
+
+    notification := Notification{
+      Service:        transition.Service,
+      DisplayName:    services[transition.Service].DisplayName,
+      Environment:    transition.Environment,
+      PreviousHealth: previous.Health,
+      Health:         transition.Health,
+      Reason:         transition.Reason,
+      Time:           now.UTC(),
+    }
+    sum := sha1.Sum([]byte(key + "\x00" + strconv.Itoa(transition.Health) + "\x00" + strconv.FormatInt(transition.Time, 10)))
+    notification.Id = hex.EncodeToString(sum[:])
+
+    for _, webhook := range webhooks[transition.Service] {
+      select {
+      case notifier.queue <- delivery{webhook: webhook, notification: notification}:
+      default:
+        log.Error("Webhook queue full, dropping notification for ", transition.Service, "/", transition.Environment, " to ", webhook.URL)
+      }
+    }
+  }
+}
+
+func (notifier *Notifier) work() {
+  for delivery := range notifier.queue {
+    // Skip a state the webhook has already been told about
+    key := delivery.webhook.URL + "\x00" + historyKey(delivery.notification.Service, delivery.notification.Environment, "")
+    if health, ok := notifier.delivered[key]; ok && health == delivery.notification.Health {
+      log.Debug("Skipping duplicate notification ", delivery.notification.Id, " to ", delivery.webhook.URL)
+      continue
+    }
+
+    if err := notifier.send(&delivery); err != nil {
+      log.Error("Unable to notify ", delivery.webhook.URL, " of ", delivery.notification.Service, "/", delivery.notification.Environment, "; ", err)
+      continue
+    }
+    notifier.delivered[key] = delivery.notification.Health
+    log.Info("Notified ", delivery.webhook.URL, " of ", delivery.notification.Service, "/", delivery.notification.Environment,
+      " health ", delivery.notification.PreviousHealth, " -> ", delivery.notification.Health)
+  }
+}
+
+// Posts the rendered payload, retrying with exponential backoff on errors and non-2xx responses
+func (notifier *Notifier) send(delivery *delivery) error {
+  payload, err := renderNotification(&delivery.webhook, &delivery.notification)
+  if err != nil {
+    return err
+  }
+  contentType := delivery.webhook.ContentType
+  if contentType == "" {
+    contentType = "application/json"
+  }
+
+  backoff := webhookBackoff
+  for attempt := 1; ; attempt++ {
+    err = notifier.post(&delivery.webhook, contentType, delivery.notification.Id, payload)
+    if err == nil || attempt == webhookAttempts {
+      return err
+    }
+    log.Warn("Webhook ", delivery.webhook.URL, " attempt ", attempt, " failed, retrying in ", backoff, "; ", err)
+    time.Sleep(backoff)
+    backoff *= 2
+  }
+}
+
+func (notifier *Notifier) post(webhook *WebhookSpec, contentType string, id string, payload []byte) error {
+  req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(payload))
+  if err != nil {
+    return err
+  }
+  req.Header.Set("Content-Type", contentType)
+  // Receivers can use the id to drop deliveries repeated by retries
+  req.Header.Set("X-Notification-Id", id)
+  for name, value := range webhook.Headers {
+    req.Header.Set(name, value)
+  }
+
+  resp, err := notifier.client.Do(req)
+  if err != nil {
+    return err
+  }
+  resp.Body.Close()
+  if resp.StatusCode < 200 || resp.StatusCode > 299 {
+    return fmt.Errorf("unexpected status %s", resp.Status)
+  }
+  return nil
+}
+
+func renderNotification(webhook *WebhookSpec, notification *Notification) ([]byte, error) {
+  tmpl, err := parseWebhookTemplate(webhook)
+  if err != nil {
+    return nil, err
+  }
+  if tmpl == nil {
+    return json.Marshal(notification)
+  }
+  var payload bytes.Buffer
+  if err := tmpl.Execute(&payload, notification); err != nil {
+    return nil, err
+  }
+  return payload.Bytes(), nil
+}
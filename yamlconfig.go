@@ -0,0 +1,156 @@
+package main
+
+import (
+  "bytes"
+  "path/filepath"
+  "regexp"
+  "strconv"
+  "strings"
+
+  yaml "gopkg.in/yaml.v3"
+)
+
+var yamlErrorPattern = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// Picks YAML for .yaml/.yml files, JSON for .json, and otherwise JSON only when the content starts with an object
+func isYAMLConfig(path string, data []byte) bool {
+  switch strings.ToLower(filepath.Ext(path)) {
+  case ".yaml", ".yml":
+    return true
+  case ".json":
+    return false
+  }
+  trimmed := bytes.TrimSpace(data)
+  return len(trimmed) == 0 || trimmed[0] != '{'
+}
+
+// Decodes a YAML document into the same generic form encoding/json produces,
+// mapping the lower-cased path of every key and value to its line
+func decodeYAMLConfig(data []byte) (interface{}, map[string]int, configProblems) {
+  var document yaml.Node
+  if err := yaml.Unmarshal(data, &document); err != nil {
+    if match := yamlErrorPattern.FindStringSubmatch(err.Error()); match != nil {
+      line, _ := strconv.Atoi(match[1])
+      return nil, nil, configProblems{{Line: line, Message: match[2]}}
+    }
+    return nil, nil, configProblems{{Message: err.Error()}}
+  }
+
+  decoder := yamlDecoder{lines: make(map[string]int), expanding: make(map[*yaml.Node]bool)}
+  raw := decoder.value(&document, "")
+  return raw, decoder.lines, decoder.problems
+}
+
+type yamlDecoder struct {
+  lines    map[string]int
+  problems configProblems
+  // Anchored nodes being decoded, so an alias back into one of them is reported instead of expanded forever
+  expanding map[*yaml.Node]bool
+}
+
+func (decoder *yamlDecoder) value(node *yaml.Node, path string) interface{} {
+  if path != "" {
+    if _, ok := decoder.lines[strings.ToLower(path)]; !ok {
+      decoder.lines[strings.ToLower(path)] = node.Line
+    }
+  }
+  if node.Anchor != "" {
+    decoder.expanding[node] = true
+    defer delete(decoder.expanding, node)
+  }
+
+  switch node.Kind {
+  case yaml.DocumentNode:
+    if len(node.Content) == 0 {
+      return nil
+    }
+    return decoder.value(node.Content[0], path)
+  case yaml.AliasNode:
+    if decoder.expanding[node.Alias] {
+      decoder.problems = append(decoder.problems, ConfigProblem{Line: node.Line, Path: path, Message: "alias *" + node.Value + " refers to its own anchor"})
+      return nil
+    }
+    return decoder.value(node.Alias, path)
+  case yaml.MappingNode:
+    // Merged mappings go in first so the mapping's own keys override them
+    object := make(map[string]interface{})
+    for i := 0; i+1 < len(node.Content); i += 2 {
+      if isYAMLMergeKey(node.Content[i]) {
+        decoder.merge(object, node.Content[i+1], path)
+      }
+    }
+    own := make(map[string]bool)
+    for i := 0; i+1 < len(node.Content); i += 2 {
+      key, value := node.Content[i], node.Content[i+1]
+      if isYAMLMergeKey(key) {
+        continue
+      }
+      childPath := joinPath(path, key.Value)
+      if own[key.Value] {
+        decoder.problems = append(decoder.problems, ConfigProblem{Line: key.Line, Path: childPath, Message: "duplicate key"})
+        continue
+      }
+      own[key.Value] = true
+      decoder.lines[strings.ToLower(childPath)] = key.Line
+      object[key.Value] = decoder.value(value, childPath)
+    }
+    return object
+  case yaml.SequenceNode:
+    array := make([]interface{}, 0, len(node.Content))
+    for i, child := range node.Content {
+      array = append(array, decoder.value(child, path+"["+strconv.Itoa(i)+"]"))
+    }
+    return array
+  default:
+    var value interface{}
+    if err := node.Decode(&value); err != nil {
+      decoder.problems = append(decoder.problems, ConfigProblem{Line: node.Line, Message: err.Error()})
+      return nil
+    }
+    // JSON has no timestamps, so keep them as written
+    if node.Tag == "!!timestamp" {
+      return node.Value
+    }
+    return value
+  }
+}
+
+func isYAMLMergeKey(key *yaml.Node) bool {
+  return key.Kind == yaml.ScalarNode && key.Value == "<<" && key.ShortTag() == "!!merge"
+}
+
+// Copies the keys of a `<<` merge value, a mapping or a list of mappings, into object
+// Earlier mappings in a list take priority over later ones, as with yaml.Unmarshal
+func (decoder *yamlDecoder) merge(object map[string]interface{}, value *yaml.Node, path string) {
+  mappings := []*yaml.Node{value}
+  resolved := value
+  if resolved.Kind == yaml.AliasNode && resolved.Alias != nil {
+    resolved = resolved.Alias
+  }
+  if resolved.Kind == yaml.SequenceNode {
+    mappings = resolved.Content
+  }
+  for i := len(mappings) - 1; i >= 0; i-- {
+    merged, ok := decoder.value(mappings[i], path).(map[string]interface{})
+    if !ok {
+      decoder.problems = append(decoder.problems, ConfigProblem{Line: mappings[i].Line, Path: path, Message: "merge key needs a mapping or a list of mappings"})
+      continue
+    }
+    for key, child := range merged {
+      object[key] = child
+    }
+  }
+}
+
+// Turns an encoding/json field path such as Services.0.Name into Services[0].Name
+func jsonFieldPath(field string) string {
+  var path string
+  for _, part := range strings.Split(field, ".") {
+    if _, err := strconv.Atoi(part); err == nil {
+      path += "[" + part + "]"
+    } else {
+      path = joinPath(path, part)
+    }
+  }
+  return path
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "io/ioutil"
+  "os"
+  "sort"
+  "time"
+
+  "github.com/aws/aws-sdk-go/service/route53"
+)
+
+// On-disk copy of the hosted zone cache so a restart can serve status before Route53 answers
+type zoneCacheFile struct {
+  Zones []cachedZone
+}
+
+type cachedZone struct {
+  Account      string `json:",omitempty"`
+  HostedZoneId string
+  Fetched      time.Time
+  Records      []*route53.ResourceRecordSet
+}
+
+// A missing file is an empty cache
+func readZoneCache(path string) (map[ZoneKey][]*route53.ResourceRecordSet, map[ZoneKey]time.Time, error) {
+  zones := make(map[ZoneKey][]*route53.ResourceRecordSet)
+  fetched := make(map[ZoneKey]time.Time)
+  data, err := ioutil.ReadFile(path)
+  if os.IsNotExist(err) {
+    return zones, fetched, nil
+  }
+  if err != nil {
+    return nil, nil, err
+  }
+
+  var file zoneCacheFile
+  if err := json.Unmarshal(data, &file); err != nil {
+    return nil, nil, err
+  }
+  for _, zone := range file.Zones {
+    key := ZoneKey{Account: zone.Account, HostedZoneId: zone.HostedZoneId}
+    zones[key] = zone.Records
+    fetched[key] = zone.Fetched
+  }
+  return zones, fetched, nil
+}
+
+// Replaces the file atomically, with zones in a stable order
+func writeZoneCache(path string, zones map[ZoneKey][]*route53.ResourceRecordSet, fetched map[ZoneKey]time.Time) error {
+  file := zoneCacheFile{Zones: make([]cachedZone, 0, len(zones))}
+  for key, records := range zones {
+    file.Zones = append(file.Zones, cachedZone{Account: key.Account, HostedZoneId: key.HostedZoneId, Fetched: fetched[key], Records: records})
+  }
+  sort.Slice(file.Zones, func(i, j int) bool {
+    if file.Zones[i].Account != file.Zones[j].Account {
+      return file.Zones[i].Account < file.Zones[j].Account
+    }
+    return file.Zones[i].HostedZoneId < file.Zones[j].HostedZoneId
+  })
+
+  data, err := json.Marshal(file)
+  if err != nil {
+    return err
+  }
+  return (&FileSink{Path: path}).Write(context.Background(), data)
+}
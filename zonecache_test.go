@@ -0,0 +1,112 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+
+  "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/service/route53"
+)
+
+func TestZoneCacheRoundTrip(t *testing.T) {
+  dir, err := ioutil.TempDir("", "zonecache")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "zones.json")
+
+  zones, fetched, err := readZoneCache(path)
+  if err != nil || len(zones) != 0 || len(fetched) != 0 {
+    t.Fatalf("missing cache = %v, %v, %v; want empty", zones, fetched, err)
+  }
+
+  record := latencyRecord("api.example.com.", "us-east-1", "hc-1")
+  record.Weight = aws.Int64(10)
+  at := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+  key := ZoneKey{Account: "|arn:aws:iam::123456789012:role/status|", HostedZoneId: "Z1"}
+  zones = map[ZoneKey][]*route53.ResourceRecordSet{key: {record}, {HostedZoneId: "Z2"}: nil}
+  fetched = map[ZoneKey]time.Time{key: at, {HostedZoneId: "Z2"}: at}
+  if err := writeZoneCache(path, zones, fetched); err != nil {
+    t.Fatal(err)
+  }
+
+  readZones, readFetched, err := readZoneCache(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(readZones) != 2 {
+    t.Fatalf("read %d zones, want 2", len(readZones))
+  }
+  got := readZones[key]
+  if len(got) != 1 || aws.StringValue(got[0].Region) != "us-east-1" || aws.Int64Value(got[0].Weight) != 10 || aws.StringValue(got[0].HealthCheckId) != "hc-1" {
+    t.Errorf("records = %v, want the written record", got)
+  }
+  if !readFetched[key].Equal(at) {
+    t.Errorf("fetched = %v, want %v", readFetched[key], at)
+  }
+
+  ioutil.WriteFile(path, []byte("{"), 0644)
+  if _, _, err := readZoneCache(path); err == nil {
+    t.Error("damaged cache read without error")
+  }
+}
+
+func TestWarmStart(t *testing.T) {
+  dir, err := ioutil.TempDir("", "zonecache")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "zones.json")
+
+  serviceConfig := &ServiceConfig{ServiceSpecs: []ServiceSpec{{
+    Name:             "api",
+    EnvironmentSpecs: []EnvironmentSpec{{Name: "prod", HostedZoneId: "Z1", DomainName: "api.example.com"}},
+  }}}
+  r53 := &fakeRoute53{zones: map[string][]*route53.ResourceRecordSet{"Z1": {recordSet("api.example.com.", "A", "hc-1")}}}
+  cw := &fakeCloudWatch{alarmStates: map[string]string{"hc-1": "OK"}}
+
+  // Without a saved cache the poller is ready once the first refresh is done, which saves the zones
+  first := newFakePoller(r53, cw)
+  if err := first.warmStart(path); err != nil {
+    t.Fatal(err)
+  }
+  select {
+  case <-first.ready:
+    t.Fatal("ready before any zones were read")
+  default:
+  }
+  first.refreshHostedZones(context.Background(), serviceConfig)
+  select {
+  case <-first.ready:
+  default:
+    t.Fatal("not ready after the first refresh")
+  }
+
+  // A restarted poller is ready straight away and serves status while Route53 is unavailable
+  r53.zoneErrors = map[string]error{"Z1": errors.New("unavailable")}
+  second := newFakePoller(r53, cw)
+  if err := second.warmStart(path); err != nil {
+    t.Fatal(err)
+  }
+  select {
+  case <-second.ready:
+  default:
+    t.Fatal("not ready after loading the zone cache")
+  }
+  fetchedAt := second.state.Zones().Fetched[ZoneKey{HostedZoneId: "Z1"}]
+  second.refreshHostedZones(context.Background(), serviceConfig)
+  if !second.state.Zones().Fetched[ZoneKey{HostedZoneId: "Z1"}].Equal(fetchedAt) {
+    t.Errorf("fetched = %v, want the cached %v", second.state.Zones().Fetched[ZoneKey{HostedZoneId: "Z1"}], fetchedAt)
+  }
+  environment := second.poll(context.Background(), serviceConfig, serviceConfig.ServiceSpecs)["api"].Environments[0]
+  if environment.Health != 0 || len(environment.Instances) != 1 {
+    t.Errorf("environment = %+v, want the healthy cached instance", environment)
+  }
+}